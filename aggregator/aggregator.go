@@ -0,0 +1,165 @@
+package aggregator
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/event-exporter/metrics"
+	"github.com/event-exporter/sinks"
+)
+
+// tickInterval is how often the aggregator looks for windows that have ended
+const tickInterval = time.Second
+
+// key identifies the records that are coalesced: those of the same reason
+// about the same object
+type key struct {
+	namespace string
+	kind      string
+	name      string
+	uid       types.UID
+	reason    string
+}
+
+// pending is the record being coalesced for a key
+type pending struct {
+	eData sinks.EventData
+	end   time.Time
+}
+
+/*
+Aggregator coalesces the records of an event, e.g. the updates Kubernetes
+makes to the count and last timestamp of a repeating event, into a single
+record. The first record of an involved object and reason opens a window,
+and the records arriving within it are merged into it. At the end of the
+window the merged record is emitted, with the latest event and an Aggregation
+summarizing the records. The previous version of the event is dropped.
+*/
+type Aggregator struct {
+	window time.Duration
+	emit   func(sinks.EventData)
+
+	mu      sync.Mutex
+	pending map[key]*pending
+	// stopped is set once Run has returned, records are then emitted right
+	// away
+	stopped bool
+}
+
+// New returns an aggregator with the given window, which hands the records
+// to emit. Run must be called for records to be emitted.
+func New(window time.Duration, emit func(sinks.EventData)) *Aggregator {
+	return &Aggregator{
+		window:  window,
+		emit:    emit,
+		pending: make(map[key]*pending),
+	}
+}
+
+// Add merges the record into the pending record of its involved object and
+// reason, or opens a new window with it
+func (a *Aggregator) Add(eData sinks.EventData) {
+	e := eData.Event
+	k := key{
+		namespace: e.InvolvedObject.Namespace,
+		kind:      e.InvolvedObject.Kind,
+		name:      e.InvolvedObject.Name,
+		uid:       e.InvolvedObject.UID,
+		reason:    e.Reason,
+	}
+	timestamp := metav1.NewTime(sinks.EventTimestamp(e))
+
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		a.emit(eData)
+		return
+	}
+	defer a.mu.Unlock()
+
+	p, ok := a.pending[k]
+	if !ok {
+		merged := eData
+		merged.OldEvent = nil
+		merged.Aggregation = &sinks.Aggregation{
+			Count:          countDelta(&eData),
+			Records:        1,
+			FirstTimestamp: timestamp,
+			LastTimestamp:  timestamp,
+		}
+		a.pending[k] = &pending{
+			eData: merged,
+			end:   time.Now().Add(a.window),
+		}
+		return
+	}
+
+	metrics.EventsCoalesced.Inc()
+	agg := p.eData.Aggregation
+	agg.Count += countDelta(&eData)
+	agg.Records++
+	if timestamp.Before(&agg.FirstTimestamp) {
+		agg.FirstTimestamp = timestamp
+	}
+	if agg.LastTimestamp.Before(&timestamp) {
+		agg.LastTimestamp = timestamp
+		p.eData.Event = e
+		p.eData.InvolvedObject = eData.InvolvedObject
+	}
+}
+
+// Run emits every record whose window has ended, until stopCh is closed. It
+// then emits the pending records before returning.
+func (a *Aggregator) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			a.flush(func(p *pending) bool {
+				return !now.Before(p.end)
+			})
+		case <-stopCh:
+			a.mu.Lock()
+			a.stopped = true
+			a.mu.Unlock()
+			a.flush(func(*pending) bool {
+				return true
+			})
+			return
+		}
+	}
+}
+
+// flush emits and forgets the pending records for which ended returns true
+func (a *Aggregator) flush(ended func(*pending) bool) {
+	var records []sinks.EventData
+	a.mu.Lock()
+	for k, p := range a.pending {
+		if ended(p) {
+			records = append(records, p.eData)
+			delete(a.pending, k)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, eData := range records {
+		a.emit(eData)
+	}
+}
+
+// countDelta returns by how much the record grew the count of the event. A
+// new event counts at least once.
+func countDelta(eData *sinks.EventData) int32 {
+	if eData.OldEvent == nil {
+		if eData.Event.Count < 1 {
+			return 1
+		}
+		return eData.Event.Count
+	}
+	return eData.Event.Count - eData.OldEvent.Count
+}
@@ -0,0 +1,169 @@
+package aggregator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/event-exporter/sinks"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newEvent returns an event of the given reason about the named pod, with
+// its count observed seconds after start
+func newEvent(pod string, reason string, count int32, seconds int) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: pod + "." + reason},
+		InvolvedObject: v1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: "default",
+			Name:      pod,
+		},
+		Reason:        reason,
+		Count:         count,
+		LastTimestamp: metav1.NewTime(start.Add(time.Duration(seconds) * time.Second)),
+	}
+}
+
+// emitted records the records emitted by an aggregator
+type emitted struct {
+	mu      sync.Mutex
+	records []sinks.EventData
+}
+
+func (e *emitted) emit(eData sinks.EventData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.records = append(e.records, eData)
+}
+
+func (e *emitted) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.records)
+}
+
+func TestAggregatorAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []sinks.EventData
+		// want are the emitted records by involved object name and reason
+		want map[string]sinks.Aggregation
+		// wantCount is the count of the emitted events
+		wantCount map[string]int32
+	}{
+		{
+			name:      "single record",
+			records:   []sinks.EventData{sinks.NewEventData(newEvent("a", "BackOff", 1, 0), nil)},
+			want:      map[string]sinks.Aggregation{"a.BackOff": {Count: 1, Records: 1, FirstTimestamp: ts(0), LastTimestamp: ts(0)}},
+			wantCount: map[string]int32{"a.BackOff": 1},
+		},
+		{
+			name: "updates of a repeating event",
+			records: []sinks.EventData{
+				sinks.NewEventData(newEvent("a", "BackOff", 3, 0), nil),
+				sinks.NewEventData(newEvent("a", "BackOff", 4, 10), newEvent("a", "BackOff", 3, 0)),
+				sinks.NewEventData(newEvent("a", "BackOff", 6, 20), newEvent("a", "BackOff", 4, 10)),
+			},
+			want:      map[string]sinks.Aggregation{"a.BackOff": {Count: 6, Records: 3, FirstTimestamp: ts(0), LastTimestamp: ts(20)}},
+			wantCount: map[string]int32{"a.BackOff": 6},
+		},
+		{
+			name: "keeps the latest event out of order",
+			records: []sinks.EventData{
+				sinks.NewEventData(newEvent("a", "BackOff", 5, 20), newEvent("a", "BackOff", 4, 10)),
+				sinks.NewEventData(newEvent("a", "BackOff", 4, 10), newEvent("a", "BackOff", 3, 0)),
+			},
+			want:      map[string]sinks.Aggregation{"a.BackOff": {Count: 2, Records: 2, FirstTimestamp: ts(10), LastTimestamp: ts(20)}},
+			wantCount: map[string]int32{"a.BackOff": 5},
+		},
+		{
+			name: "separates objects and reasons",
+			records: []sinks.EventData{
+				sinks.NewEventData(newEvent("a", "BackOff", 1, 0), nil),
+				sinks.NewEventData(newEvent("b", "BackOff", 1, 5), nil),
+				sinks.NewEventData(newEvent("a", "Unhealthy", 1, 10), nil),
+				sinks.NewEventData(newEvent("a", "BackOff", 2, 15), newEvent("a", "BackOff", 1, 0)),
+			},
+			want: map[string]sinks.Aggregation{
+				"a.BackOff":   {Count: 2, Records: 2, FirstTimestamp: ts(0), LastTimestamp: ts(15)},
+				"b.BackOff":   {Count: 1, Records: 1, FirstTimestamp: ts(5), LastTimestamp: ts(5)},
+				"a.Unhealthy": {Count: 1, Records: 1, FirstTimestamp: ts(10), LastTimestamp: ts(10)},
+			},
+			wantCount: map[string]int32{"a.BackOff": 2, "b.BackOff": 1, "a.Unhealthy": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out emitted
+			a := New(time.Minute, out.emit)
+			for _, eData := range tt.records {
+				a.Add(eData)
+			}
+			if out.len() != 0 {
+				t.Fatalf("Got %d records emitted before the end of the window", out.len())
+			}
+			a.flush(func(*pending) bool { return true })
+
+			if len(out.records) != len(tt.want) {
+				t.Fatalf("Got %d records, want %d", len(out.records), len(tt.want))
+			}
+			for _, eData := range out.records {
+				name := eData.Event.Name
+				if eData.OldEvent != nil {
+					t.Errorf("Got an old event in record %s, want none", name)
+				}
+				if want := tt.want[name]; eData.Aggregation == nil || *eData.Aggregation != want {
+					t.Errorf("Got aggregation %+v for %s, want %+v", eData.Aggregation, name, want)
+				}
+				if eData.Event.Count != tt.wantCount[name] {
+					t.Errorf("Got count %d for %s, want %d", eData.Event.Count, name, tt.wantCount[name])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	var out emitted
+	a := New(500*time.Millisecond, out.emit)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		a.Run(stopCh)
+		close(done)
+	}()
+
+	a.Add(sinks.NewEventData(newEvent("a", "BackOff", 1, 0), nil))
+	a.Add(sinks.NewEventData(newEvent("a", "BackOff", 2, 1), newEvent("a", "BackOff", 1, 0)))
+	// The window ends after 500ms, the record is emitted on the next tick
+	deadline := time.Now().Add(tickInterval + time.Second)
+	for out.len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out.len() != 1 || out.records[0].Aggregation.Records != 2 {
+		t.Fatalf("Got records %v at the end of the window, want one of 2 records", out.records)
+	}
+
+	// A record after the window opens a new one, which is emitted on stop
+	a.Add(sinks.NewEventData(newEvent("a", "BackOff", 3, 2), newEvent("a", "BackOff", 2, 1)))
+	close(stopCh)
+	<-done
+	if out.len() != 2 || out.records[1].Aggregation.Records != 1 {
+		t.Fatalf("Got records %v after stopping, want a second one of 1 record", out.records)
+	}
+
+	// Once stopped records are emitted right away
+	a.Add(sinks.NewEventData(newEvent("b", "BackOff", 1, 3), nil))
+	if out.len() != 3 || out.records[2].Event.Name != "b.BackOff" {
+		t.Errorf("Got records %v after stopping, want b.BackOff emitted right away", out.records)
+	}
+}
+
+func ts(seconds int) metav1.Time {
+	return metav1.NewTime(start.Add(time.Duration(seconds) * time.Second))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/sinks"
+)
+
+// Startup modes decide what happens to the events already stored in the
+// cluster when the exporter starts
+const (
+	// startupModeReplayAll exports every event returned by the initial list
+	startupModeReplayAll = "replay-all"
+	// startupModeSkipInitialList skips events last seen before the exporter
+	// started
+	startupModeSkipInitialList = "skip-initial-list"
+	// startupModeResume skips events whose current version was already
+	// exported according to the checkpoint
+	startupModeResume = "resume-from-checkpoint"
+)
+
+// checkpointConfigMapKey is the ConfigMap data key holding the checkpoint
+const checkpointConfigMapKey = "checkpoint"
+
+// maxConfigMapCheckpointSize keeps the checkpoint ConfigMap below the 1MiB
+// limit of Kubernetes objects, with room for its metadata
+const maxConfigMapCheckpointSize = 900 * 1024
+
+// startupPolicy decides whether an event has been exported before
+type startupPolicy struct {
+	mode string
+
+	// startTime is when the exporter started, used by startupModeSkipInitialList
+	startTime time.Time
+
+	// checkpoint is only used by startupModeResume, and saved every saveInterval
+	checkpoint   *checkpoint
+	saveInterval time.Duration
+}
+
+func newStartupPolicy(mode string, store checkpointStore, saveInterval time.Duration) (*startupPolicy, error) {
+	p := &startupPolicy{
+		mode:         mode,
+		startTime:    time.Now(),
+		saveInterval: saveInterval,
+	}
+
+	switch mode {
+	case startupModeReplayAll, startupModeSkipInitialList:
+	case startupModeResume:
+		if store == nil {
+			return nil, fmt.Errorf("startup mode %s requires a checkpoint file or ConfigMap", mode)
+		}
+		cp, err := newCheckpoint(store)
+		if err != nil {
+			return nil, err
+		}
+		p.checkpoint = cp
+	default:
+		return nil, fmt.Errorf("unknown startup mode %q, must be one of %s, %s or %s", mode, startupModeReplayAll, startupModeSkipInitialList, startupModeResume)
+	}
+	return p, nil
+}
+
+// exported returns true if the event must not be exported again. added is
+// true for events delivered by the informer as new, which includes the
+// events of the initial list.
+func (p *startupPolicy) exported(e *v1.Event, added bool) bool {
+	switch p.mode {
+	case startupModeSkipInitialList:
+		return added && sinks.EventTimestamp(e).Before(p.startTime)
+	case startupModeResume:
+		return p.checkpoint.exported(e)
+	}
+	return false
+}
+
+// markExported records that the current version of the event was exported.
+// It is called once the event is handed to the sinks, so the events still
+// buffered in memory when the process dies are not exported again on
+// restart: resuming is at-most-once for them.
+func (p *startupPolicy) markExported(e *v1.Event) {
+	if p.checkpoint != nil {
+		p.checkpoint.markExported(e)
+	}
+}
+
+// forget drops the event from the checkpoint
+func (p *startupPolicy) forget(e *v1.Event) {
+	if p.checkpoint != nil {
+		p.checkpoint.forget(e)
+	}
+}
+
+// run periodically saves the checkpoint until stopCh is closed, then saves
+// it one last time. The checkpoint is first pruned to the events that still
+// exist.
+func (p *startupPolicy) run(events []*v1.Event, stopCh <-chan struct{}) {
+	if p.checkpoint == nil {
+		return
+	}
+	p.checkpoint.retain(events)
+
+	wait.Until(p.checkpoint.save, p.saveInterval, stopCh)
+	p.checkpoint.save()
+}
+
+// checkpoint tracks the resourceVersion last exported for each event UID
+type checkpoint struct {
+	store checkpointStore
+
+	mu       sync.Mutex
+	versions map[string]string
+	dirty    bool
+}
+
+func newCheckpoint(store checkpointStore) (*checkpoint, error) {
+	versions, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint: %v", err)
+	}
+	if versions == nil {
+		versions = make(map[string]string)
+	}
+	log.Infof("Loaded checkpoint of %d events", len(versions))
+	return &checkpoint{
+		store:    store,
+		versions: versions,
+	}, nil
+}
+
+func (c *checkpoint) exported(e *v1.Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	version, ok := c.versions[string(e.UID)]
+	return ok && version == e.ResourceVersion
+}
+
+func (c *checkpoint) markExported(e *v1.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[string(e.UID)] = e.ResourceVersion
+	c.dirty = true
+}
+
+func (c *checkpoint) forget(e *v1.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.versions[string(e.UID)]; ok {
+		delete(c.versions, string(e.UID))
+		c.dirty = true
+	}
+}
+
+// retain drops every event from the checkpoint that is not in events
+func (c *checkpoint) retain(events []*v1.Event) {
+	existing := make(map[string]bool, len(events))
+	for _, e := range events {
+		existing[string(e.UID)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uid := range c.versions {
+		if !existing[uid] {
+			delete(c.versions, uid)
+			c.dirty = true
+		}
+	}
+}
+
+// save persists the checkpoint if it has changed since the last save
+func (c *checkpoint) save() {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	versions := make(map[string]string, len(c.versions))
+	for uid, version := range c.versions {
+		versions[uid] = version
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err := c.store.Save(versions); err != nil {
+		log.Warningf("Failed to save checkpoint: %v", err)
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return
+	}
+	log.V(3).Infof("Saved checkpoint of %d events", len(versions))
+}
+
+// checkpointStore persists a checkpoint
+type checkpointStore interface {
+	// Load returns the saved checkpoint, or nil if there is none
+	Load() (map[string]string, error)
+	Save(versions map[string]string) error
+}
+
+// fileCheckpointStore keeps the checkpoint in a local JSON file
+type fileCheckpointStore struct {
+	path string
+}
+
+func (s *fileCheckpointStore) Load() (map[string]string, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions map[string]string
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	return versions, nil
+}
+
+func (s *fileCheckpointStore) Save(versions map[string]string) error {
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a partial checkpoint
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// configMapCheckpointStore keeps the checkpoint in a ConfigMap
+type configMapCheckpointStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *configMapCheckpointStore) Load() (map[string]string, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[checkpointConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+	var versions map[string]string
+	if err := json.Unmarshal([]byte(data), &versions); err != nil {
+		return nil, fmt.Errorf("failed to parse ConfigMap %s/%s: %v", s.namespace, s.name, err)
+	}
+	return versions, nil
+}
+
+func (s *configMapCheckpointStore) Save(versions map[string]string) error {
+	data, err := marshalCheckpoint(versions, maxConfigMapCheckpointSize)
+	if err != nil {
+		return err
+	}
+
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	cm, err := configMaps.Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+			},
+			Data: map[string]string{checkpointConfigMapKey: string(data)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[checkpointConfigMapKey] = string(data)
+	_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// marshalCheckpoint serializes the checkpoint in at most maxSize bytes. If
+// it does not fit, the events with the oldest resourceVersions are left out,
+// which only means they are exported again after a restart.
+func marshalCheckpoint(versions map[string]string, maxSize int) ([]byte, error) {
+	data, err := json.Marshal(versions)
+	if err != nil || len(data) <= maxSize {
+		return data, err
+	}
+
+	uids := make([]string, 0, len(versions))
+	for uid := range versions {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return newerResourceVersion(versions[uids[i]], versions[uids[j]])
+	})
+	// Entries are about the same size, start from the share that should fit
+	// and shrink until it does
+	keep := len(uids) * maxSize / len(data)
+	for {
+		kept := make(map[string]string, keep)
+		for _, uid := range uids[:keep] {
+			kept[uid] = versions[uid]
+		}
+		if data, err = json.Marshal(kept); err != nil || len(data) <= maxSize {
+			log.Warningf("Checkpoint of %d events is too large, keeping the %d most recent", len(versions), keep)
+			return data, err
+		}
+		keep = keep * 9 / 10
+	}
+}
+
+// newerResourceVersion returns true if a is more recent than b. Resource
+// versions are opaque, but they are increasing integers in practice; others
+// are ordered as strings.
+func newerResourceVersion(a string, b string) bool {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return a > b
+	}
+	return na > nb
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/event-exporter/sinks"
+)
+
+func TestMarshalCheckpoint(t *testing.T) {
+	versions := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		versions[fmt.Sprintf("uid-%04d", i)] = fmt.Sprint(i * 10)
+	}
+	full, err := json.Marshal(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxSize  int
+		wantKept int
+	}{
+		{"fits", len(full), 1000},
+		{"too large", len(full) / 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := marshalCheckpoint(versions, tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) > tt.maxSize {
+				t.Errorf("Got %d bytes, want at most %d", len(data), tt.maxSize)
+			}
+			var kept map[string]string
+			if err := json.Unmarshal(data, &kept); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantKept != 0 && len(kept) != tt.wantKept {
+				t.Errorf("Got %d events, want %d", len(kept), tt.wantKept)
+			}
+			// The pruned events are the oldest ones
+			oldest := 1000
+			for uid := range kept {
+				var i int
+				fmt.Sscanf(uid, "uid-%04d", &i)
+				if i < oldest {
+					oldest = i
+				}
+			}
+			if want := 1000 - len(kept); oldest != want {
+				t.Errorf("Got oldest kept event %d, want %d", oldest, want)
+			}
+		})
+	}
+}
+
+func TestNewerResourceVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10", "9", true},
+		{"9", "10", false},
+		{"5", "5", false},
+		{"b", "a", true},
+	}
+	for _, tt := range tests {
+		if got := newerResourceVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerResourceVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// recordingSink records the exported events as name@resourceVersion
+type recordingSink struct {
+	mu       sync.Mutex
+	exported []string
+}
+
+func (s *recordingSink) UpdateEvents(eData sinks.EventData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exported = append(s.exported, eData.Event.Name+"@"+eData.Event.ResourceVersion)
+}
+
+// has returns true if the event was exported
+func (s *recordingSink) has(event string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.exported {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted returns the exported events in sorted order
+func (s *recordingSink) sorted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exported := append([]string(nil), s.exported...)
+	sort.Strings(exported)
+	return exported
+}
+
+// testExporter is a single run of the exporter against a fake clientset,
+// with the event handlers of the EventRouter exporting to a recordingSink
+type testExporter struct {
+	source *eventSource
+	sink   *recordingSink
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// startTestExporter starts the exporter with the startup mode, keeping its
+// checkpoint in a ConfigMap. It creates a new event named start and returns
+// once it has been exported, and so have the events of the initial list.
+func startTestExporter(t *testing.T, client *fake.Clientset, mode string, start string) *testExporter {
+	t.Helper()
+	store := &configMapCheckpointStore{client: client, namespace: "kube-system", name: "event-exporter"}
+	startup, err := newStartupPolicy(mode, store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := informers.NewSharedInformerFactory(client, 0)
+	source, err := newEventSource([]informers.SharedInformerFactory{factory}, eventsAPICore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &testExporter{
+		source: source,
+		sink:   &recordingSink{},
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	er := &EventRouter{
+		client:  client,
+		source:  source,
+		sinks:   map[string]sinks.EventSinkInterface{"test": e.sink},
+		startup: startup,
+	}
+	source.addEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    er.addEvent,
+		UpdateFunc: er.updateEvent,
+		DeleteFunc: er.deleteEvent,
+	})
+	factory.Start(e.stopCh)
+	if !cache.WaitForCacheSync(e.stopCh, source.hasSynced) {
+		t.Fatal("Timed out waiting for the event cache to sync")
+	}
+	go func() {
+		defer close(e.done)
+		startup.run(source.list(), e.stopCh)
+	}()
+
+	// The handlers are called in order, once a new event is exported so are
+	// the events of the initial list
+	createEvent(t, client, newCheckpointTestEvent(start, start, "1", time.Now()))
+	waitFor(t, "the start event", func() bool { return e.sink.has(start + "@1") })
+	return e
+}
+
+// stop stops the exporter, which saves its checkpoint
+func (e *testExporter) stop() {
+	close(e.stopCh)
+	<-e.done
+	e.source.shutdown()
+}
+
+func createEvent(t *testing.T, client *fake.Clientset, event *v1.Event) {
+	t.Helper()
+	if _, err := client.CoreV1().Events(event.Namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func updateEvent(t *testing.T, client *fake.Clientset, event *v1.Event) {
+	t.Helper()
+	if _, err := client.CoreV1().Events(event.Namespace).Update(context.TODO(), event, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newCheckpointTestEvent returns an event last seen at lastSeen. The fake
+// clientset does not set resource versions, so they are given.
+func newCheckpointTestEvent(name string, uid string, resourceVersion string, lastSeen time.Time) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			UID:             types.UID(uid),
+			ResourceVersion: resourceVersion,
+		},
+		LastTimestamp: metav1.NewTime(lastSeen),
+	}
+}
+
+func TestStartupReplayAll(t *testing.T) {
+	client := fake.NewSimpleClientset(newCheckpointTestEvent("old", "old", "1", time.Now().Add(-time.Hour)))
+	e := startTestExporter(t, client, startupModeReplayAll, "start")
+	defer e.stop()
+
+	if want := []string{"old@1", "start@1"}; fmt.Sprint(e.sink.sorted()) != fmt.Sprint(want) {
+		t.Errorf("Got exported events %v, want %v", e.sink.sorted(), want)
+	}
+}
+
+func TestStartupSkipInitialList(t *testing.T) {
+	client := fake.NewSimpleClientset(newCheckpointTestEvent("old", "old", "1", time.Now().Add(-time.Hour)))
+	e := startTestExporter(t, client, startupModeSkipInitialList, "start")
+	defer e.stop()
+
+	// Updates of the events of the initial list are exported
+	updateEvent(t, client, newCheckpointTestEvent("old", "old", "2", time.Now()))
+	waitFor(t, "the update", func() bool { return e.sink.has("old@2") })
+
+	if want := []string{"old@2", "start@1"}; fmt.Sprint(e.sink.sorted()) != fmt.Sprint(want) {
+		t.Errorf("Got exported events %v, want %v", e.sink.sorted(), want)
+	}
+}
+
+func TestStartupResumeFromCheckpoint(t *testing.T) {
+	lastSeen := time.Now().Add(-time.Hour)
+	client := fake.NewSimpleClientset(
+		newCheckpointTestEvent("a", "a", "1", lastSeen),
+		newCheckpointTestEvent("b", "b", "1", lastSeen),
+		newCheckpointTestEvent("c", "c", "1", lastSeen),
+	)
+
+	// Without a checkpoint every event is exported
+	first := startTestExporter(t, client, startupModeResume, "start")
+	updateEvent(t, client, newCheckpointTestEvent("b", "b", "2", time.Now()))
+	waitFor(t, "the update", func() bool { return first.sink.has("b@2") })
+	first.stop()
+	if want := []string{"a@1", "b@1", "b@2", "c@1", "start@1"}; fmt.Sprint(first.sink.sorted()) != fmt.Sprint(want) {
+		t.Errorf("Got exported events %v in the first run, want %v", first.sink.sorted(), want)
+	}
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "event-exporter", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Got no checkpoint ConfigMap: %v", err)
+	}
+	var versions map[string]string
+	if err := json.Unmarshal([]byte(cm.Data[checkpointConfigMapKey]), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions["b"] != "2" {
+		t.Errorf("Got checkpoint %v, want b at version 2", versions)
+	}
+
+	// While the exporter is down a is updated, c is replaced by an event of
+	// the same name and d is created
+	updateEvent(t, client, newCheckpointTestEvent("a", "a", "3", time.Now()))
+	if err := client.CoreV1().Events("default").Delete(context.TODO(), "c", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	createEvent(t, client, newCheckpointTestEvent("c", "c-new", "1", time.Now()))
+	createEvent(t, client, newCheckpointTestEvent("d", "d", "1", time.Now()))
+
+	// The restarted exporter resumes from the checkpoint in the ConfigMap,
+	// only exporting the events whose UID and version it has not exported
+	second := startTestExporter(t, client, startupModeResume, "restart")
+	defer second.stop()
+	if want := []string{"a@3", "c@1", "d@1", "restart@1"}; fmt.Sprint(second.sink.sorted()) != fmt.Sprint(want) {
+		t.Errorf("Got exported events %v after the restart, want %v", second.sink.sorted(), want)
+	}
+}
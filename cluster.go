@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/sinks"
+)
+
+// clusterIDNamespace is the namespace whose UID identifies the cluster, it
+// exists in every cluster and is never recreated
+const clusterIDNamespace = "kube-system"
+
+// clusterConfig holds the cluster metadata flags
+type clusterConfig struct {
+	name        string
+	region      string
+	account     string
+	environment string
+	labels      string
+	discoverID  bool
+}
+
+// parseClusterLabels parses a comma separated list of key=value pairs
+func parseClusterLabels(s string) (map[string]string, error) {
+	var labels map[string]string
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid cluster label %q, expected key=value", pair)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// newClusterMetadata returns the metadata attached to every event, or nil if
+// none is configured. The region defaults to the AWS_REGION Env variable.
+func newClusterMetadata(client kubernetes.Interface, config clusterConfig) (*sinks.ClusterMetadata, error) {
+	labels, err := parseClusterLabels(config.labels)
+	if err != nil {
+		return nil, err
+	}
+	m := &sinks.ClusterMetadata{
+		Name:        config.name,
+		Region:      config.region,
+		Account:     config.account,
+		Environment: config.environment,
+		Labels:      labels,
+	}
+	if m.Region == "" {
+		m.Region = os.Getenv("AWS_REGION")
+	}
+	if config.discoverID {
+		ns, err := client.CoreV1().Namespaces().Get(context.TODO(), clusterIDNamespace, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the %s namespace: %v", clusterIDNamespace, err)
+		}
+		m.ID = string(ns.UID)
+	}
+
+	if m.Name == "" && m.ID == "" && m.Account == "" && m.Environment == "" && len(m.Labels) == 0 {
+		// The region alone does not identify a cluster
+		return nil, nil
+	}
+	log.Infof("Cluster metadata: name=%q id=%q region=%q account=%q environment=%q labels=%v",
+		m.Name, m.ID, m.Region, m.Account, m.Environment, m.Labels)
+	return m, nil
+}
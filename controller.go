@@ -3,99 +3,326 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/event-exporter/aggregator"
+	"github.com/event-exporter/enricher"
+	"github.com/event-exporter/filters"
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
 	sinks "github.com/event-exporter/sinks"
-	log "k8s.io/klog"
+	log "k8s.io/klog/v2"
 
-	v1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
+// routeStatsInterval is how often the number of events matched by each route
+// is logged
+const routeStatsInterval = time.Minute
+
+// sinkCheckInterval is how often a failed sink connectivity check is retried
+const sinkCheckInterval = 10 * time.Second
+
+// informerStallTimeout is how long the event informer may go without listing
+// or opening a watch before it is considered stalled. The reflector re-opens
+// its watch at least every 10 minutes.
+const informerStallTimeout = 15 * time.Minute
+
 // EventRouter is responsible for maintaining a stream of kubernetes
 // system Events and pushing them to another channel for storage
 type EventRouter struct {
 	// client is the main kubernetes interface
 	client kubernetes.Interface
 
-	// store of events populated by the shared informer
-	lister corelisters.EventLister
+	// source is the informers of the events, normalized to core/v1 Events
+	source *eventSource
+
+	// filter decides which events are pushed to the sinks
+	filter *filters.Filter
+
+	// routes decide which sinks an event is pushed to, if there are none
+	// every event goes to every sink
+	routes []*filters.Route
+
+	// enricher attaches the metadata of the involved object to the events,
+	// nil if enrichment is disabled
+	enricher *enricher.Enricher
+
+	// cluster is attached to every event, nil if no cluster metadata is
+	// configured
+	cluster *sinks.ClusterMetadata
+
+	// aggregator coalesces the records of an event before they are routed,
+	// nil if aggregation is disabled. aggregating is done once it has emitted
+	// its pending records on shutdown.
+	aggregator  *aggregator.Aggregator
+	aggregating sync.WaitGroup
 
-	// returns true if the event store has been synced
-	listerSynched cache.InformerSynced
+	// event sinks keyed by name
+	sinks map[string]sinks.EventSinkInterface
 
-	// event sink
-	sink sinks.EventSinkInterface
+	// startup decides which events have been exported before
+	startup *startupPolicy
+
+	// synced is ready once the event store has been synced
+	synced *health.Condition
+
+	// sinkChecks are ready once the connectivity check of each sink has
+	// succeeded, keyed by sink name
+	sinkChecks map[string]*health.Condition
+
+	// stopSinks stops the sinks, which flush their buffered events and then
+	// mark themselves done in sinksDone. Shutdown waits for them for at most
+	// shutdownTimeout.
+	stopSinks       context.CancelFunc
+	sinksDone       sync.WaitGroup
+	shutdownTimeout time.Duration
 }
 
 // NewEventRouter will create a new event router using the input params
-func newEventRouter(kubeClient kubernetes.Interface, eventsInformer coreinformers.EventInformer) *EventRouter {
-	var ctx context.Context
+func newEventRouter(kubeClient kubernetes.Interface, source *eventSource, filter *filters.Filter, routes []*filters.Route, enricher *enricher.Enricher, cluster *sinks.ClusterMetadata, aggregationWindow time.Duration, startup *startupPolicy, shutdownTimeout time.Duration) *EventRouter {
+	// The sinks are not stopped with the informer, but only once it has
+	// stopped delivering events, see drainSinks
+	ctx, stopSinks := context.WithCancel(context.Background())
 
 	er := &EventRouter{
-		client: kubeClient,
-		sink:   sinks.ManufactureSink(ctx),
+		client:          kubeClient,
+		source:          source,
+		filter:          filter,
+		routes:          routes,
+		enricher:        enricher,
+		cluster:         cluster,
+		startup:         startup,
+		synced:          health.NewCondition("event informer"),
+		stopSinks:       stopSinks,
+		shutdownTimeout: shutdownTimeout,
+	}
+	er.sinks = sinks.ManufactureSinks(ctx, &er.sinksDone)
+	if aggregationWindow > 0 {
+		er.aggregator = aggregator.New(aggregationWindow, er.route)
 	}
 
-	eventsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	er.sinkChecks = make(map[string]*health.Condition, len(er.sinks))
+	for name := range er.sinks {
+		er.sinkChecks[name] = health.NewCondition(fmt.Sprintf("sink %s", name))
+	}
+
+	for _, r := range routes {
+		for _, name := range r.Sinks {
+			if _, ok := er.sinks[name]; !ok {
+				log.Exitf("Route %s refers to sink %s which is not configured in SINK", r.Name, name)
+			}
+		}
+		metrics.RegisterRouteMatches(r.Name, r.Matched)
+	}
+
+	source.addEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    er.addEvent,
 		UpdateFunc: er.updateEvent,
 		DeleteFunc: er.deleteEvent,
 	})
-	er.lister = eventsInformer.Lister()
-	er.listerSynched = eventsInformer.Informer().HasSynced
 	return er
 }
 
-// Run starts the EventRouter/Controller.
-func (er *EventRouter) Run(stopCh <-chan struct{}) {
+// Run starts the EventRouter/Controller. Once stopCh is closed it flushes
+// the sinks and saves the checkpoint, and returns an error if the sinks could
+// not be flushed in time.
+func (er *EventRouter) Run(stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer log.Infof("Shutting down EventRouter")
 
 	log.Infof("Starting EventRouter")
 
+	for name, ready := range er.sinkChecks {
+		go er.checkSink(name, ready, stopCh)
+	}
+	if er.aggregator != nil {
+		er.aggregating.Add(1)
+		go func() {
+			defer er.aggregating.Done()
+			er.aggregator.Run(stopCh)
+		}()
+	}
+
 	// here is where we kick the caches into gear
-	if !cache.WaitForCacheSync(stopCh, er.listerSynched) {
+	synced := []cache.InformerSynced{er.source.hasSynced}
+	if er.enricher != nil {
+		synced = append(synced, er.enricher.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		utilruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
-		return
+		return er.drainSinks()
 	}
+	er.synced.SetReady()
+	if len(er.routes) > 0 {
+		go wait.Until(er.logRouteStats, routeStatsInterval, stopCh)
+	}
+
+	// The checkpoint is saved for the last time after the sinks are flushed
+	checkpointStopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		er.startup.run(er.source.list(), checkpointStopCh)
+	}()
 	<-stopCh
+	err := er.drainSinks()
+	close(checkpointStopCh)
+	wg.Wait()
+	return err
+}
+
+// drainSinks waits for the informers to stop delivering events, then stops
+// the sinks and waits up to shutdownTimeout for them to flush the events they
+// still buffer
+func (er *EventRouter) drainSinks() error {
+	// The event handlers may still be pushing events, and then the pending
+	// aggregated records go to the sinks
+	er.source.shutdown()
+	er.aggregating.Wait()
+
+	log.Infof("Flushing sinks")
+	er.stopSinks()
+
+	done := make(chan struct{})
+	go func() {
+		er.sinksDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("Flushed sinks")
+		return nil
+	case <-time.After(er.shutdownTimeout):
+		return fmt.Errorf("sinks did not flush within %v", er.shutdownTimeout)
+	}
+}
+
+// checkSink retries the connectivity check of the sink until it succeeds
+func (er *EventRouter) checkSink(name string, ready *health.Condition, stopCh <-chan struct{}) {
+	wait.PollImmediateUntil(sinkCheckInterval, func() (bool, error) {
+		if err := sinks.CheckSink(er.sinks[name]); err != nil {
+			log.Warningf("Sink %s connectivity check failed: %v", name, err)
+			return false, nil
+		}
+		log.Infof("Sink %s connectivity check succeeded", name)
+		ready.SetReady()
+		return true, nil
+	}, stopCh)
 }
 
 // addEvent is called when an event is created, or during the initial list
 func (er *EventRouter) addEvent(obj interface{}) {
-	event := obj.(*v1.Event)
-	//fmt.Println(event)
-	er.sink.UpdateEvents(event, nil)
+	event := er.source.normalize(obj)
+	if event == nil {
+		log.V(2).Infof("Object is not an event: %+v", obj)
+		return
+	}
+	metrics.EventsReceived.WithLabelValues("ADDED").Inc()
+	if er.startup.exported(event, true) {
+		metrics.EventsSkipped.Inc()
+		log.V(4).Infof("Event %s/%s was exported before, skipping", event.Namespace, event.Name)
+		return
+	}
+	er.export(sinks.NewEventData(event, nil))
+	er.startup.markExported(event)
 }
 
 // updateEvent is called any time there is an update to an existing event
 func (er *EventRouter) updateEvent(objOld interface{}, objNew interface{}) {
-	oldEvent := objOld.(*v1.Event)
-	newEvent := objNew.(*v1.Event)
-	er.sink.UpdateEvents(newEvent, oldEvent)
+	oldEvent := er.source.normalize(objOld)
+	newEvent := er.source.normalize(objNew)
+	if oldEvent == nil || newEvent == nil {
+		log.V(2).Infof("Object is not an event: %+v", objNew)
+		return
+	}
+	metrics.EventsReceived.WithLabelValues("UPDATED").Inc()
+	if er.startup.exported(newEvent, false) {
+		metrics.EventsSkipped.Inc()
+		log.V(4).Infof("Event %s/%s was exported before, skipping", newEvent.Namespace, newEvent.Name)
+		return
+	}
+	er.export(sinks.NewEventData(newEvent, oldEvent))
+	er.startup.markExported(newEvent)
+}
+
+// export enriches the event and hands it to the aggregator if there is one,
+// or routes it right away
+func (er *EventRouter) export(eData sinks.EventData) {
+	eData.Cluster = er.cluster
+	if !er.filter.Matches(&eData) {
+		metrics.EventsFiltered.Inc()
+		log.V(4).Infof("Event %s/%s filtered out", eData.Event.Namespace, eData.Event.Name)
+		return
+	}
+	if er.enricher != nil {
+		er.enricher.Enrich(&eData)
+	}
+	if er.aggregator != nil {
+		er.aggregator.Add(eData)
+		return
+	}
+	er.route(eData)
+}
+
+// route pushes the event to the sinks of every matching route, or to every
+// sink if there are no routes
+func (er *EventRouter) route(eData sinks.EventData) {
+
+	if len(er.routes) == 0 {
+		for _, sink := range er.sinks {
+			sink.UpdateEvents(eData)
+		}
+		return
+	}
+
+	targets := make(map[string]bool, len(er.sinks))
+	for _, r := range er.routes {
+		if r.Matches(&eData) {
+			for _, name := range r.Sinks {
+				targets[name] = true
+			}
+		}
+	}
+	if len(targets) == 0 {
+		log.V(4).Infof("Event %s/%s matched no route", eData.Event.Namespace, eData.Event.Name)
+	}
+	for name := range targets {
+		er.sinks[name].UpdateEvents(eData)
+	}
+}
+
+// logRouteStats logs the number of events each route has matched
+func (er *EventRouter) logRouteStats() {
+	for _, r := range er.routes {
+		log.V(2).Infof("Route %s has matched %d events", r.Name, r.Matched())
+	}
 }
 
 // deleteEvent should only occur when the system garbage collects events via TTL expiration
 func (er *EventRouter) deleteEvent(obj interface{}) {
-	event, ok := obj.(*v1.Event)
+	event := er.source.normalize(obj)
 
-	if !ok {
+	if event == nil {
 		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 		if !ok {
-			log.V(2).Info("Object is neither event nor tombstone: %+v", obj)
+			log.V(2).Infof("Object is neither event nor tombstone: %+v", obj)
 			return
 		}
-		event, ok = tombstone.Obj.(*v1.Event)
-		if !ok {
-			log.V(2).Info("Tombstone contains object that is not a pod: %+v", obj)
+		event = er.source.normalize(tombstone.Obj)
+		if event == nil {
+			log.V(2).Infof("Tombstone contains object that is not a pod: %+v", obj)
 			return
 		}
 	}
+	metrics.EventsReceived.WithLabelValues("DELETED").Inc()
+	er.startup.forget(event)
 	// NOTE: This should *only* happen on TTL expiration there
 	// is no reason to push this to a sink
-	log.V(5).Info("Event Deleted from the system:\n%v", event)
+	log.V(5).Infof("Event Deleted from the system:\n%v", event)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/event-exporter/filters"
+	"github.com/event-exporter/sinks"
+)
+
+func TestEventRouterRoute(t *testing.T) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(bytes.NewBufferString(`
+routes:
+  - name: payments
+    sinks: [http, syslog]
+    match:
+      include:
+        - namespaces: [payments]
+  - name: warnings
+    sinks: [http]
+    match:
+      include:
+        - types: [Warning]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viper.Reset()
+	routes, err := filters.RoutesFromConfig("routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorders := map[string]*recordingSink{"http": {}, "syslog": {}, "CWL": {}}
+	er := &EventRouter{routes: routes, sinks: make(map[string]sinks.EventSinkInterface)}
+	for name, s := range recorders {
+		er.sinks[name] = s
+	}
+	for i, e := range []struct{ namespace, eventType string }{
+		{"payments", v1.EventTypeWarning},
+		{"payments", v1.EventTypeNormal},
+		{"default", v1.EventTypeWarning},
+		{"default", v1.EventTypeNormal},
+	} {
+		er.route(sinks.NewEventData(&v1.Event{
+			ObjectMeta: metav1.ObjectMeta{Namespace: e.namespace, Name: fmt.Sprint(i), ResourceVersion: "1"},
+			Type:       e.eventType,
+		}, nil))
+	}
+
+	// An event matching several routes to the same sink is delivered once,
+	// and sinks without a route get nothing
+	want := map[string][]string{
+		"http":   {"0@1", "1@1", "2@1"},
+		"syslog": {"0@1", "1@1"},
+		"CWL":    nil,
+	}
+	for name, s := range recorders {
+		if got := s.sorted(); fmt.Sprint(got) != fmt.Sprint(want[name]) {
+			t.Errorf("Got events %v routed to %s, want %v", got, name, want[name])
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package enricher
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/sinks"
+)
+
+// maxOwnerDepth bounds the number of owners followed to the top-level
+// controller, e.g. Pod, ReplicaSet, Deployment
+const maxOwnerDepth = 5
+
+// lastAppliedAnnotation holds a copy of the whole object applied by kubectl,
+// it is never attached
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+/*
+Enricher attaches the metadata of the object an event is about to the event
+data: labels, annotations, owner references, the top-level controller and for
+Pods the node name. Objects are looked up in the caches of shared informers
+for Pods, Nodes, ReplicaSets, Deployments and Jobs, other kinds are not
+enriched. The ReplicaSets and Jobs are also used to follow the owners of
+Pods up to their Deployment or CronJob.
+*/
+type Enricher struct {
+	// namespaced holds the listers of each factory, e.g. one per watched
+	// namespace
+	namespaced []namespacedListers
+	nodes      corelisters.NodeLister
+
+	synced []cache.InformerSynced
+}
+
+// namespacedListers are the listers of the namespaced kinds of a factory
+type namespacedListers struct {
+	pods        corelisters.PodLister
+	replicaSets appslisters.ReplicaSetLister
+	deployments appslisters.DeploymentLister
+	jobs        batchlisters.JobLister
+}
+
+// New creates an enricher using the informers of the factories, which must
+// be started afterwards. Namespaced objects are looked up in every factory,
+// Nodes only in the first one.
+func New(factories ...informers.SharedInformerFactory) *Enricher {
+	e := &Enricher{}
+	for i, factory := range factories {
+		pods := factory.Core().V1().Pods()
+		replicaSets := factory.Apps().V1().ReplicaSets()
+		deployments := factory.Apps().V1().Deployments()
+		jobs := factory.Batch().V1().Jobs()
+		e.namespaced = append(e.namespaced, namespacedListers{
+			pods:        pods.Lister(),
+			replicaSets: replicaSets.Lister(),
+			deployments: deployments.Lister(),
+			jobs:        jobs.Lister(),
+		})
+		e.synced = append(e.synced,
+			pods.Informer().HasSynced,
+			replicaSets.Informer().HasSynced,
+			deployments.Informer().HasSynced,
+			jobs.Informer().HasSynced,
+		)
+
+		if i == 0 {
+			nodes := factory.Core().V1().Nodes()
+			e.nodes = nodes.Lister()
+			e.synced = append(e.synced, nodes.Informer().HasSynced)
+		}
+	}
+	return e
+}
+
+// HasSynced returns true once the caches of all informers have been synced
+func (e *Enricher) HasSynced() bool {
+	for _, synced := range e.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Enrich sets the involved object metadata of the event data, if the object
+// is found
+func (e *Enricher) Enrich(eData *sinks.EventData) {
+	ref := &eData.Event.InvolvedObject
+	obj := e.lookup(ref.APIVersion, ref.Kind, ref.Namespace, ref.Name)
+	if obj == nil {
+		return
+	}
+	// The object was replaced by another one of the same name. The kubelet
+	// sets the UID of Nodes in events to their name, so Nodes are only
+	// matched on their name.
+	if ref.UID != "" && ref.UID != obj.GetUID() && ref.Kind != "Node" {
+		return
+	}
+
+	m := &sinks.ObjectMetadata{
+		Labels:          obj.GetLabels(),
+		Annotations:     obj.GetAnnotations(),
+		OwnerReferences: obj.GetOwnerReferences(),
+		Owner:           e.topOwner(ref.Namespace, obj),
+	}
+	if _, ok := m.Annotations[lastAppliedAnnotation]; ok {
+		annotations := make(map[string]string, len(m.Annotations)-1)
+		for k, v := range m.Annotations {
+			if k != lastAppliedAnnotation {
+				annotations[k] = v
+			}
+		}
+		m.Annotations = annotations
+	}
+	if pod, ok := obj.(*v1.Pod); ok {
+		m.NodeName = pod.Spec.NodeName
+	}
+	eData.InvolvedObject = m
+}
+
+// topOwner follows the controllers of the object up to the one that is not
+// controlled itself, it returns nil if the object has no controller
+func (e *Enricher) topOwner(namespace string, obj metav1.Object) *metav1.OwnerReference {
+	owner := metav1.GetControllerOf(obj)
+	for depth := 0; owner != nil && depth < maxOwnerDepth; depth++ {
+		parent := e.lookup(owner.APIVersion, owner.Kind, namespace, owner.Name)
+		if parent == nil || parent.GetUID() != owner.UID {
+			break
+		}
+		next := metav1.GetControllerOf(parent)
+		if next == nil {
+			break
+		}
+		owner = next
+	}
+	return owner
+}
+
+// lookup returns the object from the informer caches, or nil if its kind is
+// not cached or it does not exist
+func (e *Enricher) lookup(apiVersion string, kind string, namespace string, name string) metav1.Object {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil
+	}
+
+	if gv.Group == "" && kind == "Node" {
+		node, err := e.nodes.Get(name)
+		if err != nil {
+			logLookupError(kind, namespace, name, err)
+			return nil
+		}
+		return node
+	}
+	for _, l := range e.namespaced {
+		var obj metav1.Object
+		switch {
+		case gv.Group == "" && kind == "Pod":
+			obj, err = l.pods.Pods(namespace).Get(name)
+		case (gv.Group == "apps" || gv.Group == "extensions") && kind == "ReplicaSet":
+			obj, err = l.replicaSets.ReplicaSets(namespace).Get(name)
+		case (gv.Group == "apps" || gv.Group == "extensions") && kind == "Deployment":
+			obj, err = l.deployments.Deployments(namespace).Get(name)
+		case gv.Group == "batch" && kind == "Job":
+			obj, err = l.jobs.Jobs(namespace).Get(name)
+		default:
+			return nil
+		}
+		if err == nil {
+			return obj
+		}
+		logLookupError(kind, namespace, name, err)
+	}
+	return nil
+}
+
+// logLookupError logs the failure to look up an object, unless it was not
+// found
+func logLookupError(kind string, namespace string, name string, err error) {
+	if !errors.IsNotFound(err) {
+		log.Warningf("Failed to look up %s %s/%s: %v", kind, namespace, name, err)
+	}
+}
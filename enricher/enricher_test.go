@@ -0,0 +1,169 @@
+package enricher
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/event-exporter/sinks"
+)
+
+// newTestEnricher returns an enricher with the objects in the caches of its
+// informers, which are not started
+func newTestEnricher(t *testing.T, objects ...metav1.Object) *Enricher {
+	t.Helper()
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	e := New(factory)
+	for _, obj := range objects {
+		var informer cache.SharedIndexInformer
+		switch obj.(type) {
+		case *v1.Pod:
+			informer = factory.Core().V1().Pods().Informer()
+		case *v1.Node:
+			informer = factory.Core().V1().Nodes().Informer()
+		case *appsv1.ReplicaSet:
+			informer = factory.Apps().V1().ReplicaSets().Informer()
+		case *appsv1.Deployment:
+			informer = factory.Apps().V1().Deployments().Informer()
+		case *batchv1.Job:
+			informer = factory.Batch().V1().Jobs().Informer()
+		default:
+			t.Fatalf("Unsupported object %T", obj)
+		}
+		if err := informer.GetIndexer().Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+// meta returns the metadata of an object controlled by the owner, if any
+func meta(namespace string, name string, owner *metav1.OwnerReference) metav1.ObjectMeta {
+	m := metav1.ObjectMeta{
+		Namespace: namespace,
+		Name:      name,
+		UID:       types.UID(name + "-uid"),
+		Labels:    map[string]string{"app": "web"},
+	}
+	if owner != nil {
+		m.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return m
+}
+
+// controller returns a controller reference to the object
+func controller(apiVersion string, kind string, name string) *metav1.OwnerReference {
+	isController := true
+	return &metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       name,
+		UID:        types.UID(name + "-uid"),
+		Controller: &isController,
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: meta("default", "web", nil)}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: meta("default", "web-5d4f", controller("apps/v1", "Deployment", "web"))}
+	pod := &v1.Pod{
+		ObjectMeta: meta("default", "web-5d4f-x2x", controller("apps/v1", "ReplicaSet", "web-5d4f")),
+		Spec:       v1.PodSpec{NodeName: "node-1"},
+	}
+	cronJobOwner := controller("batch/v1", "CronJob", "backup")
+	job := &batchv1.Job{ObjectMeta: meta("default", "backup-1", cronJobOwner)}
+	jobPod := &v1.Pod{ObjectMeta: meta("default", "backup-1-a2c", controller("batch/v1", "Job", "backup-1"))}
+	node := &v1.Node{ObjectMeta: meta("", "node-1", nil)}
+	node.UID = "7d9a2c71-2f4e-4bb6-9f43-0c1f2a5e8b10"
+	e := newTestEnricher(t, deployment, replicaSet, pod, job, jobPod, node)
+
+	tests := []struct {
+		name string
+		ref  v1.ObjectReference
+		// want is the expected metadata, nil if the event is not enriched
+		want *sinks.ObjectMetadata
+	}{
+		{
+			name: "pod owned by a deployment",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: pod.Name, UID: pod.UID},
+			want: &sinks.ObjectMetadata{
+				Labels:          pod.Labels,
+				OwnerReferences: pod.OwnerReferences,
+				Owner:           controller("apps/v1", "Deployment", "web"),
+				NodeName:        "node-1",
+			},
+		},
+		{
+			name: "pod owned by a cron job",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: jobPod.Name, UID: jobPod.UID},
+			want: &sinks.ObjectMetadata{
+				Labels:          jobPod.Labels,
+				OwnerReferences: jobPod.OwnerReferences,
+				Owner:           cronJobOwner,
+			},
+		},
+		{
+			name: "deployment",
+			ref:  v1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"},
+			want: &sinks.ObjectMetadata{Labels: deployment.Labels},
+		},
+		{
+			name: "replaced pod",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: pod.Name, UID: "old-uid"},
+		},
+		{
+			name: "missing pod",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "missing"},
+		},
+		{
+			name: "kind not cached",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "web"},
+		},
+		{
+			// The kubelet sets the UID of the node to its name
+			name: "node event of the kubelet",
+			ref:  v1.ObjectReference{Kind: "Node", Name: "node-1", UID: "node-1"},
+			want: &sinks.ObjectMetadata{Labels: node.Labels},
+		},
+		{
+			name: "node event",
+			ref:  v1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: "node-1", UID: node.UID},
+			want: &sinks.ObjectMetadata{Labels: node.Labels},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eData := sinks.NewEventData(&v1.Event{InvolvedObject: tt.ref}, nil)
+			e.Enrich(&eData)
+			if !reflect.DeepEqual(eData.InvolvedObject, tt.want) {
+				t.Errorf("Got involved object %+v, want %+v", eData.InvolvedObject, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnrichDropsLastAppliedConfiguration(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: meta("default", "web", nil)}
+	deployment.Annotations = map[string]string{lastAppliedAnnotation: "{}", "team": "a"}
+	e := newTestEnricher(t, deployment)
+
+	eData := sinks.NewEventData(&v1.Event{InvolvedObject: v1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}}, nil)
+	e.Enrich(&eData)
+	if eData.InvolvedObject == nil {
+		t.Fatal("Got no involved object")
+	}
+	if want := map[string]string{"team": "a"}; !reflect.DeepEqual(eData.InvolvedObject.Annotations, want) {
+		t.Errorf("Got annotations %v, want %v", eData.InvolvedObject.Annotations, want)
+	}
+	if _, ok := deployment.Annotations[lastAppliedAnnotation]; !ok {
+		t.Error("Got the annotations of the cached object modified")
+	}
+}
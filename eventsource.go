@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Values of -eventsAPI
+const (
+	// eventsAPICore watches the core/v1 Events API
+	eventsAPICore = "core/v1"
+	// eventsAPIEvents watches the events.k8s.io/v1 Events API
+	eventsAPIEvents = "events.k8s.io/v1"
+)
+
+/*
+eventSource is the informers of one of the Events APIs, one per factory, e.g.
+one per watched namespace. Both APIs serve the same objects, the events it
+delivers are normalized to core/v1 Events, the model of EventData, so the
+filters and sinks work the same with either.
+*/
+type eventSource struct {
+	factories []informers.SharedInformerFactory
+	informers []cache.SharedIndexInformer
+	// normalize converts an object of the informers to a core/v1 Event, it
+	// returns nil if the object is not an event
+	normalize func(obj interface{}) *v1.Event
+}
+
+// newEventSource returns the informers of the Events API named api, one of
+// eventsAPICore and eventsAPIEvents, from each of the factories
+func newEventSource(factories []informers.SharedInformerFactory, api string) (*eventSource, error) {
+	s := &eventSource{factories: factories}
+	switch api {
+	case eventsAPICore:
+		for _, factory := range factories {
+			s.informers = append(s.informers, factory.Core().V1().Events().Informer())
+		}
+		s.normalize = func(obj interface{}) *v1.Event {
+			e, _ := obj.(*v1.Event)
+			return e
+		}
+	case eventsAPIEvents:
+		for _, factory := range factories {
+			s.informers = append(s.informers, factory.Events().V1().Events().Informer())
+		}
+		s.normalize = func(obj interface{}) *v1.Event {
+			if e, ok := obj.(*eventsv1.Event); ok {
+				return coreEventFromEventsV1(e)
+			}
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported events API %q, must be one of %s or %s", api, eventsAPICore, eventsAPIEvents)
+	}
+	return s, nil
+}
+
+// addEventHandler adds the handler to every informer
+func (s *eventSource) addEventHandler(handler cache.ResourceEventHandler) {
+	for _, informer := range s.informers {
+		informer.AddEventHandler(handler)
+	}
+}
+
+// hasSynced returns true once every informer has synced
+func (s *eventSource) hasSynced() bool {
+	for _, informer := range s.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdown waits for the informers, which must have been stopped, to return.
+// Once it returns no event handler is running nor called anymore.
+func (s *eventSource) shutdown() {
+	for _, factory := range s.factories {
+		factory.Shutdown()
+	}
+}
+
+// list returns every event in the informer caches
+func (s *eventSource) list() []*v1.Event {
+	var events []*v1.Event
+	for _, informer := range s.informers {
+		for _, obj := range informer.GetStore().List() {
+			if e := s.normalize(obj); e != nil {
+				events = append(events, e)
+			}
+		}
+	}
+	return events
+}
+
+// coreEventFromEventsV1 converts an events.k8s.io event to a core/v1 Event:
+// the regarding object is the involved object, the note the message and the
+// deprecated fields are the source, timestamps and count. Events recorded
+// through events.k8s.io do not set the deprecated fields, they are then
+// derived from the reporting controller, the event time and the series, so
+// every normalized event has a last timestamp and a count.
+func coreEventFromEventsV1(e *eventsv1.Event) *v1.Event {
+	event := &v1.Event{
+		ObjectMeta:          e.ObjectMeta,
+		InvolvedObject:      e.Regarding,
+		Reason:              e.Reason,
+		Message:             e.Note,
+		Source:              e.DeprecatedSource,
+		FirstTimestamp:      e.DeprecatedFirstTimestamp,
+		LastTimestamp:       e.DeprecatedLastTimestamp,
+		Count:               e.DeprecatedCount,
+		Type:                e.Type,
+		EventTime:           e.EventTime,
+		Action:              e.Action,
+		Related:             e.Related,
+		ReportingController: e.ReportingController,
+		ReportingInstance:   e.ReportingInstance,
+	}
+	if e.Series != nil {
+		event.Series = &v1.EventSeries{
+			Count:            e.Series.Count,
+			LastObservedTime: e.Series.LastObservedTime,
+		}
+	}
+
+	if event.Source.Component == "" {
+		event.Source.Component = e.ReportingController
+	}
+	if event.FirstTimestamp.IsZero() && !e.EventTime.IsZero() {
+		event.FirstTimestamp = metav1.NewTime(e.EventTime.Time)
+	}
+	if event.LastTimestamp.IsZero() {
+		switch {
+		case e.Series != nil && !e.Series.LastObservedTime.IsZero():
+			event.LastTimestamp = metav1.NewTime(e.Series.LastObservedTime.Time)
+		case !e.EventTime.IsZero():
+			event.LastTimestamp = metav1.NewTime(e.EventTime.Time)
+		default:
+			event.LastTimestamp = event.FirstTimestamp
+		}
+	}
+	if event.Count == 0 {
+		event.Count = 1
+		if e.Series != nil {
+			event.Count = e.Series.Count
+		}
+	}
+	return event
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCoreEventFromEventsV1(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	meta := metav1.ObjectMeta{Namespace: "default", Name: "web.1", UID: "uid", ResourceVersion: "42"}
+	regarding := v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web", UID: "pod-uid"}
+	related := &v1.ObjectReference{Kind: "Node", Name: "node-1"}
+
+	// newEvent returns an events.k8s.io event with the fields that are
+	// mapped as is, modified by f
+	newEvent := func(f func(e *eventsv1.Event)) *eventsv1.Event {
+		e := &eventsv1.Event{
+			ObjectMeta:          meta,
+			EventTime:           metav1.NewMicroTime(t1),
+			ReportingController: "kubelet",
+			ReportingInstance:   "kubelet-node-1",
+			Action:              "Pulling",
+			Reason:              "BackOff",
+			Regarding:           regarding,
+			Related:             related,
+			Note:                "Back-off pulling image",
+			Type:                v1.EventTypeWarning,
+		}
+		f(e)
+		return e
+	}
+	// want returns the core/v1 event with the fields that are mapped as is,
+	// modified by f
+	want := func(f func(e *v1.Event)) *v1.Event {
+		e := &v1.Event{
+			ObjectMeta:          meta,
+			InvolvedObject:      regarding,
+			Reason:              "BackOff",
+			Message:             "Back-off pulling image",
+			Type:                v1.EventTypeWarning,
+			EventTime:           metav1.NewMicroTime(t1),
+			Action:              "Pulling",
+			Related:             related,
+			ReportingController: "kubelet",
+			ReportingInstance:   "kubelet-node-1",
+		}
+		f(e)
+		return e
+	}
+
+	tests := []struct {
+		name  string
+		event *eventsv1.Event
+		want  *v1.Event
+	}{
+		{
+			name: "deprecated fields",
+			event: newEvent(func(e *eventsv1.Event) {
+				e.DeprecatedSource = v1.EventSource{Component: "kubelet", Host: "node-1"}
+				e.DeprecatedFirstTimestamp = metav1.NewTime(t1)
+				e.DeprecatedLastTimestamp = metav1.NewTime(t2)
+				e.DeprecatedCount = 3
+			}),
+			want: want(func(e *v1.Event) {
+				e.Source = v1.EventSource{Component: "kubelet", Host: "node-1"}
+				e.FirstTimestamp = metav1.NewTime(t1)
+				e.LastTimestamp = metav1.NewTime(t2)
+				e.Count = 3
+			}),
+		},
+		{
+			name:  "single event",
+			event: newEvent(func(e *eventsv1.Event) {}),
+			want: want(func(e *v1.Event) {
+				e.Source = v1.EventSource{Component: "kubelet"}
+				e.FirstTimestamp = metav1.NewTime(t1)
+				e.LastTimestamp = metav1.NewTime(t1)
+				e.Count = 1
+			}),
+		},
+		{
+			name: "series",
+			event: newEvent(func(e *eventsv1.Event) {
+				e.Series = &eventsv1.EventSeries{Count: 5, LastObservedTime: metav1.NewMicroTime(t2)}
+			}),
+			want: want(func(e *v1.Event) {
+				e.Series = &v1.EventSeries{Count: 5, LastObservedTime: metav1.NewMicroTime(t2)}
+				e.Source = v1.EventSource{Component: "kubelet"}
+				e.FirstTimestamp = metav1.NewTime(t1)
+				e.LastTimestamp = metav1.NewTime(t2)
+				e.Count = 5
+			}),
+		},
+		{
+			name: "no event time",
+			event: newEvent(func(e *eventsv1.Event) {
+				e.EventTime = metav1.MicroTime{}
+				e.DeprecatedFirstTimestamp = metav1.NewTime(t1)
+			}),
+			want: want(func(e *v1.Event) {
+				e.EventTime = metav1.MicroTime{}
+				e.Source = v1.EventSource{Component: "kubelet"}
+				e.FirstTimestamp = metav1.NewTime(t1)
+				e.LastTimestamp = metav1.NewTime(t1)
+				e.Count = 1
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coreEventFromEventsV1(tt.event); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got event\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package filters
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/viper"
+
+	"github.com/event-exporter/sinks"
+)
+
+// Selector matches events on their metadata. Every field that is set must
+// match for the selector to match; a list field matches if the event's value
+// is one of its entries. An empty selector matches every event.
+type Selector struct {
+	Namespaces []string `mapstructure:"namespaces"`
+	// Types are the event types, Normal or Warning
+	Types      []string `mapstructure:"types"`
+	Reasons    []string `mapstructure:"reasons"`
+	Components []string `mapstructure:"components"`
+	// Kinds and Names match the involved object
+	Kinds []string `mapstructure:"kinds"`
+	Names []string `mapstructure:"names"`
+	// Message is a regular expression matched against the event message
+	Message string `mapstructure:"message"`
+	// Clusters and Environments match the name and environment of the
+	// cluster metadata
+	Clusters     []string `mapstructure:"clusters"`
+	Environments []string `mapstructure:"environments"`
+
+	message *regexp.Regexp
+}
+
+// Filter decides which events are exported. An event passes if it matches
+// any of the Include selectors (or there are none) and none of the Exclude
+// selectors.
+type Filter struct {
+	Include []Selector `mapstructure:"include"`
+	Exclude []Selector `mapstructure:"exclude"`
+}
+
+// NewFromConfig reads the filter stored under key in the viper config. It
+// returns nil if no filter is configured.
+func NewFromConfig(key string) (*Filter, error) {
+	if !viper.IsSet(key) {
+		return nil, nil
+	}
+	f := &Filter{}
+	if err := viper.UnmarshalKey(key, f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	if err := f.Compile(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return f, nil
+}
+
+// Compile prepares the selectors of the filter, it must be called before
+// Matches.
+func (f *Filter) Compile() error {
+	for i := range f.Include {
+		if err := f.Include[i].Compile(); err != nil {
+			return err
+		}
+	}
+	for i := range f.Exclude {
+		if err := f.Exclude[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the event should be exported. A nil filter
+// matches every event.
+func (f *Filter) Matches(e *sinks.EventData) bool {
+	if f == nil {
+		return true
+	}
+	for i := range f.Exclude {
+		if f.Exclude[i].Matches(e) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for i := range f.Include {
+		if f.Include[i].Matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile compiles the message regular expression of the selector
+func (s *Selector) Compile() error {
+	if s.Message == "" {
+		return nil
+	}
+	re, err := regexp.Compile(s.Message)
+	if err != nil {
+		return fmt.Errorf("invalid message regex %q: %v", s.Message, err)
+	}
+	s.message = re
+	return nil
+}
+
+// Matches returns true if the event matches every field set on the selector
+func (s *Selector) Matches(e *sinks.EventData) bool {
+	event := e.Event
+	var cluster sinks.ClusterMetadata
+	if e.Cluster != nil {
+		cluster = *e.Cluster
+	}
+	return matchesAny(s.Namespaces, event.Namespace) &&
+		matchesAny(s.Types, event.Type) &&
+		matchesAny(s.Reasons, event.Reason) &&
+		matchesAny(s.Components, event.Source.Component) &&
+		matchesAny(s.Kinds, event.InvolvedObject.Kind) &&
+		matchesAny(s.Names, event.InvolvedObject.Name) &&
+		(s.message == nil || s.message.MatchString(event.Message)) &&
+		matchesAny(s.Clusters, cluster.Name) &&
+		matchesAny(s.Environments, cluster.Environment)
+}
+
+// matchesAny returns true if values is empty or contains value
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package filters
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/event-exporter/sinks"
+)
+
+// readConfig loads the YAML config into viper for the test
+func readConfig(t *testing.T, config string) {
+	t.Helper()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(config)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+// newEventData returns the event data of a Warning about the named pod
+func newEventData(namespace string, reason string, pod string, message string) *sinks.EventData {
+	eData := sinks.NewEventData(&v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: namespace, Name: pod + ".1"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Namespace: namespace, Name: pod},
+		Type:           v1.EventTypeWarning,
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: "kubelet"},
+	}, nil)
+	return &eData
+}
+
+func TestFilterMatches(t *testing.T) {
+	readConfig(t, `
+filter:
+  include:
+    - namespaces: [prod-a, prod-b]
+      types: [Warning]
+    - components: [scheduler]
+  exclude:
+    - reasons: [BackOff]
+    - kinds: [Pod]
+      names: [noisy-pod]
+    - message: "^Readiness probe failed"
+`)
+	f, err := NewFromConfig("filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled := newEventData("dev", "Scheduled", "web", "")
+	scheduled.Event.Type = v1.EventTypeNormal
+	scheduled.Event.Source.Component = "scheduler"
+	normal := newEventData("prod-a", "Pulled", "web", "")
+	normal.Event.Type = v1.EventTypeNormal
+
+	tests := []struct {
+		name  string
+		event *sinks.EventData
+		want  bool
+	}{
+		{"included namespace and type", newEventData("prod-a", "Unhealthy", "web", "Liveness probe failed"), true},
+		{"second included namespace", newEventData("prod-b", "Unhealthy", "web", ""), true},
+		{"namespace not included", newEventData("dev", "Unhealthy", "web", ""), false},
+		{"type not included", normal, false},
+		{"second include selector", scheduled, true},
+		{"excluded reason", newEventData("prod-a", "BackOff", "web", ""), false},
+		{"excluded kind and name", newEventData("prod-a", "Unhealthy", "noisy-pod", ""), false},
+		{"excluded name of another kind only", newEventData("prod-a", "Unhealthy", "noisy-pod-2", ""), true},
+		{"excluded message", newEventData("prod-a", "Unhealthy", "web", "Readiness probe failed: 503"), false},
+		{"message not matching at the start", newEventData("prod-a", "Unhealthy", "web", "Pod: Readiness probe failed"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Matches(tt.event); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatchesCluster(t *testing.T) {
+	s := Selector{Clusters: []string{"prod"}, Environments: []string{"production"}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cluster *sinks.ClusterMetadata
+		want    bool
+	}{
+		{"matching", &sinks.ClusterMetadata{Name: "prod", Environment: "production"}, true},
+		{"other cluster", &sinks.ClusterMetadata{Name: "dev", Environment: "production"}, false},
+		{"other environment", &sinks.ClusterMetadata{Name: "prod", Environment: "staging"}, false},
+		{"no cluster metadata", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eData := newEventData("default", "Unhealthy", "web", "")
+			eData.Cluster = tt.cluster
+			if got := s.Matches(eData); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterWithoutSelectors(t *testing.T) {
+	var nilFilter *Filter
+	for name, f := range map[string]*Filter{"nil": nilFilter, "empty": {}} {
+		if !f.Matches(newEventData("default", "Unhealthy", "web", "")) {
+			t.Errorf("Got the %s filter not matching, want every event matched", name)
+		}
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "not configured", config: "routes: []", wantNil: true},
+		{name: "valid", config: "filter:\n  include:\n    - types: [Warning]"},
+		{name: "invalid message", config: "filter:\n  exclude:\n    - message: \"(\"", wantErr: true},
+		{name: "invalid selector", config: "filter:\n  include: Warning", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readConfig(t, tt.config)
+			f, err := NewFromConfig("filter")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (f == nil) != tt.wantNil {
+				t.Errorf("Got filter %+v, want nil %v", f, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package filters
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"github.com/event-exporter/sinks"
+)
+
+// Route sends the events matching a filter to a set of sinks, and counts the
+// events it has matched.
+type Route struct {
+	Name  string   `mapstructure:"name"`
+	Sinks []string `mapstructure:"sinks"`
+	Match Filter   `mapstructure:"match"`
+
+	matched uint64
+}
+
+// RoutesFromConfig reads the routes stored under key in the viper config. It
+// returns nil if no routes are configured.
+func RoutesFromConfig(key string) ([]*Route, error) {
+	if !viper.IsSet(key) {
+		return nil, nil
+	}
+	var routes []*Route
+	if err := viper.UnmarshalKey(key, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+
+	names := make(map[string]bool, len(routes))
+	for i, r := range routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route-%d", i)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("invalid %s: route %s is declared more than once", key, r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Sinks) == 0 {
+			return nil, fmt.Errorf("invalid %s: route %s has no sinks", key, r.Name)
+		}
+		if err := r.Match.Compile(); err != nil {
+			return nil, fmt.Errorf("invalid %s: route %s: %v", key, r.Name, err)
+		}
+	}
+	return routes, nil
+}
+
+// Matches returns true if the event should be sent to the sinks of the
+// route, counting the event if it does.
+func (r *Route) Matches(e *sinks.EventData) bool {
+	if !r.Match.Matches(e) {
+		return false
+	}
+	atomic.AddUint64(&r.matched, 1)
+	return true
+}
+
+// Matched returns the number of events the route has matched
+func (r *Route) Matched() uint64 {
+	return atomic.LoadUint64(&r.matched)
+}
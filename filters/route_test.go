@@ -0,0 +1,96 @@
+package filters
+
+import (
+	"testing"
+)
+
+func TestRoutesFromConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "not configured", config: "filter: {}"},
+		{
+			name: "valid",
+			config: `
+routes:
+  - name: warnings
+    sinks: [http]
+    match:
+      include:
+        - types: [Warning]
+  - sinks: [CWL]
+`,
+			wantNames: []string{"warnings", "route-1"},
+		},
+		{name: "no sinks", config: "routes:\n  - name: warnings", wantErr: true},
+		{name: "duplicate name", config: "routes:\n  - name: a\n    sinks: [CWL]\n  - name: a\n    sinks: [http]", wantErr: true},
+		{name: "duplicate default name", config: "routes:\n  - sinks: [CWL]\n  - name: route-0\n    sinks: [http]", wantErr: true},
+		{name: "invalid message", config: "routes:\n  - sinks: [CWL]\n    match:\n      include:\n        - message: \"[\"", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readConfig(t, tt.config)
+			routes, err := RoutesFromConfig("routes")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(routes) != len(tt.wantNames) {
+				t.Fatalf("Got %d routes, want %v", len(routes), tt.wantNames)
+			}
+			for i, r := range routes {
+				if r.Name != tt.wantNames[i] {
+					t.Errorf("Got route %d named %s, want %s", i, r.Name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	readConfig(t, `
+routes:
+  - name: payments
+    sinks: [http]
+    match:
+      include:
+        - namespaces: [payments]
+      exclude:
+        - reasons: [BackOff]
+  - name: everything
+    sinks: [CWL]
+`)
+	routes, err := RoutesFromConfig("routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, everything := routes[0], routes[1]
+
+	tests := []struct {
+		name           string
+		namespace      string
+		reason         string
+		wantPayments   bool
+		wantEverything bool
+	}{
+		{"matching both", "payments", "Unhealthy", true, true},
+		{"excluded from payments", "payments", "BackOff", false, true},
+		{"other namespace", "default", "Unhealthy", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eData := newEventData(tt.namespace, tt.reason, "web", "")
+			if got := payments.Matches(eData); got != tt.wantPayments {
+				t.Errorf("Got payments route matching %v, want %v", got, tt.wantPayments)
+			}
+			if got := everything.Matches(eData); got != tt.wantEverything {
+				t.Errorf("Got everything route matching %v, want %v", got, tt.wantEverything)
+			}
+		})
+	}
+	if payments.Matched() != 1 || everything.Matched() != 3 {
+		t.Errorf("Got %d and %d events matched, want 1 and 3", payments.Matched(), everything.Matched())
+	}
+}
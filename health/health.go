@@ -0,0 +1,137 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mu         sync.Mutex
+	heartbeats []*Heartbeat
+	conditions []*Condition
+)
+
+// Heartbeat lets a long running goroutine report that it is making progress.
+// The goroutine is considered stalled, and the process not live, if it has
+// not beaten for longer than its timeout.
+type Heartbeat struct {
+	name    string
+	timeout time.Duration
+
+	// last is the time of the last beat in nanoseconds since the epoch
+	last int64
+}
+
+// NewHeartbeat registers a new liveness heartbeat, starting with a beat
+func NewHeartbeat(name string, timeout time.Duration) *Heartbeat {
+	h := &Heartbeat{
+		name:    name,
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+	}
+	mu.Lock()
+	heartbeats = append(heartbeats, h)
+	mu.Unlock()
+	return h
+}
+
+// Beat records that the goroutine is making progress
+func (h *Heartbeat) Beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+func (h *Heartbeat) check(now time.Time) error {
+	last := time.Unix(0, atomic.LoadInt64(&h.last))
+	if now.Sub(last) > h.timeout {
+		return fmt.Errorf("%s stalled, last heartbeat %v ago", h.name, now.Sub(last).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Condition is a readiness condition. It is not met until SetReady is called
+// and stays met afterwards.
+type Condition struct {
+	name  string
+	ready int32
+}
+
+// NewCondition registers a new readiness condition
+func NewCondition(name string) *Condition {
+	c := &Condition{name: name}
+	mu.Lock()
+	conditions = append(conditions, c)
+	mu.Unlock()
+	return c
+}
+
+// SetReady marks the condition as met
+func (c *Condition) SetReady() {
+	atomic.StoreInt32(&c.ready, 1)
+}
+
+func (c *Condition) check() error {
+	if atomic.LoadInt32(&c.ready) == 0 {
+		return fmt.Errorf("%s not ready", c.name)
+	}
+	return nil
+}
+
+// Handler serves /healthz, which fails if any heartbeat has stalled, and
+// /readyz, which fails until every readiness condition is met
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, readiness())
+	})
+	return mux
+}
+
+func liveness() []error {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	var errs []error
+	for _, h := range heartbeats {
+		if err := h.check(now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func readiness() []error {
+	mu.Lock()
+	defer mu.Unlock()
+	var errs []error
+	for _, c := range conditions {
+		if err := c.check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// respond writes ok, or the failed checks with a 503 status
+func respond(w http.ResponseWriter, errs []error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	sort.Strings(msgs)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, msg := range msgs {
+		fmt.Fprintln(w, msg)
+	}
+}
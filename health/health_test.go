@@ -0,0 +1,77 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reset unregisters the heartbeats and conditions of the test once it is done
+func reset(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		heartbeats, conditions = nil, nil
+	})
+}
+
+// get returns the status code and body of the probe at path
+func get(t *testing.T, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHeartbeatCheck(t *testing.T) {
+	reset(t)
+	h := NewHeartbeat("sink test", time.Minute)
+	now := time.Now()
+	if err := h.check(now); err != nil {
+		t.Errorf("Got error %v right after the heartbeat was created", err)
+	}
+	if err := h.check(now.Add(2 * time.Minute)); err == nil {
+		t.Error("Got no error after the timeout")
+	}
+	atomic.StoreInt64(&h.last, now.Add(-2*time.Minute).UnixNano())
+	h.Beat()
+	if err := h.check(time.Now()); err != nil {
+		t.Errorf("Got error %v after a beat", err)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	reset(t)
+	NewHeartbeat("sink a", time.Minute)
+	stalled := NewHeartbeat("sink b", time.Minute)
+
+	if code, body := get(t, "/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("Got %d %q, want 200 ok", code, body)
+	}
+	atomic.StoreInt64(&stalled.last, time.Now().Add(-2*time.Minute).UnixNano())
+	code, body := get(t, "/healthz")
+	if code != http.StatusServiceUnavailable || !strings.HasPrefix(body, "sink b stalled") || strings.Contains(body, "sink a") {
+		t.Errorf("Got %d %q, want 503 with sink b stalled", code, body)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	reset(t)
+	a := NewCondition("sink a")
+	b := NewCondition("sink b")
+
+	if code, body := get(t, "/readyz"); code != http.StatusServiceUnavailable || body != "sink a not ready\nsink b not ready\n" {
+		t.Errorf("Got %d %q, want 503 with both sinks not ready", code, body)
+	}
+	a.SetReady()
+	if code, body := get(t, "/readyz"); code != http.StatusServiceUnavailable || body != "sink b not ready\n" {
+		t.Errorf("Got %d %q, want 503 with sink b not ready", code, body)
+	}
+	b.SetReady()
+	if code, body := get(t, "/readyz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("Got %d %q, want 200 ok", code, body)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	log "k8s.io/klog/v2"
+)
+
+// leaderElectionConfig configures the Lease used to elect the single replica
+// that exports events
+type leaderElectionConfig struct {
+	// namespace and name of the Lease object
+	namespace string
+	name      string
+
+	// identity of this replica, unique among the replicas
+	identity string
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// runWithLeaderElection blocks until ctx is done or the lease is lost, calling
+// run with a context that is cancelled as soon as ctx is done or this replica
+// stops leading. When ctx is done the lease is renewed until run has returned,
+// e.g. flushed the sinks, and then released so another replica can take over
+// without waiting for it to expire. It returns only after run has returned.
+func runWithLeaderElection(ctx context.Context, client kubernetes.Interface, config leaderElectionConfig, run func(ctx context.Context)) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: config.namespace,
+			Name:      config.name,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: config.identity,
+		},
+	}
+
+	// The elector does not wait for OnStartedLeading to return, so running
+	// tracks it. Once the elector is done stopped keeps it from starting late.
+	var (
+		mu      sync.Mutex
+		stopped bool
+		running sync.WaitGroup
+	)
+
+	// The elector runs until electionCtx is done, which once ctx is done is
+	// only after run has returned
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   config.leaseDuration,
+		RenewDeadline:   config.renewDeadline,
+		RetryPeriod:     config.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            config.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leadingCtx context.Context) {
+				mu.Lock()
+				if stopped {
+					mu.Unlock()
+					return
+				}
+				running.Add(1)
+				mu.Unlock()
+				defer running.Done()
+
+				runCtx, cancel := context.WithCancel(leadingCtx)
+				defer cancel()
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-runCtx.Done():
+					}
+				}()
+
+				log.Infof("%s started leading", config.identity)
+				run(runCtx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s stopped leading", config.identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.identity {
+					log.Infof("%s is the leader, waiting for the lease", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-electionCtx.Done():
+			return
+		}
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		running.Wait()
+		stopElection()
+	}()
+
+	log.Infof("Waiting for lease %s/%s as %s", config.namespace, config.name, config.identity)
+	le.Run(electionCtx)
+
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	running.Wait()
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// candidate runs runWithLeaderElection and records whether it is leading
+type candidate struct {
+	identity string
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu      sync.Mutex
+	leading bool
+	led     int
+}
+
+// startCandidate starts a candidate, which takes flush to return once its
+// context is cancelled
+func startCandidate(t *testing.T, client *fake.Clientset, identity string, flush time.Duration) *candidate {
+	c := &candidate{identity: identity, done: make(chan struct{})}
+	config := leaderElectionConfig{
+		namespace:     "kube-system",
+		name:          "event-exporter",
+		identity:      identity,
+		leaseDuration: time.Second,
+		renewDeadline: 500 * time.Millisecond,
+		retryPeriod:   100 * time.Millisecond,
+	}
+
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(c.done)
+		err := runWithLeaderElection(ctx, client, config, func(ctx context.Context) {
+			c.setLeading(true)
+			<-ctx.Done()
+			time.Sleep(flush)
+			c.setLeading(false)
+		})
+		if err != nil {
+			t.Errorf("%s failed to run the leader election: %v", identity, err)
+		}
+	}()
+	return c
+}
+
+func (c *candidate) setLeading(leading bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leading = leading
+	if leading {
+		c.led++
+	}
+}
+
+func (c *candidate) isLeading() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leading
+}
+
+// timesLed returns how many times the candidate started leading
+func (c *candidate) timesLed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.led
+}
+
+// leaders returns the candidates that are leading
+func leaders(candidates ...*candidate) []string {
+	var identities []string
+	for _, c := range candidates {
+		if c.isLeading() {
+			identities = append(identities, c.identity)
+		}
+	}
+	return identities
+}
+
+// waitFor polls cond until it returns true or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunWithLeaderElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := startCandidate(t, client, "a", 0)
+	b := startCandidate(t, client, "b", 0)
+	defer b.cancel()
+	defer a.cancel()
+
+	waitFor(t, "a leader", func() bool { return len(leaders(a, b)) > 0 })
+
+	// The other candidate keeps waiting while the leader renews the lease,
+	// for longer than the lease duration
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); {
+		if l := leaders(a, b); len(l) != 1 {
+			t.Fatalf("Got leaders %v, want exactly one", l)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leader, follower := a, b
+	if b.isLeading() {
+		leader, follower = b, a
+	}
+	leader.cancel()
+	select {
+	case <-leader.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return after its context was cancelled", leader.identity)
+	}
+	if leader.isLeading() {
+		t.Errorf("%s is still leading after returning", leader.identity)
+	}
+
+	// The lease is released, the follower takes over before it would expire
+	start := time.Now()
+	waitFor(t, "the handoff", follower.isLeading)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Handoff took %v, longer than the lease duration", elapsed)
+	}
+	if leader.timesLed() != 1 || follower.timesLed() != 1 {
+		t.Errorf("Got %s leading %d times and %s %d times, want once each", leader.identity, leader.timesLed(), follower.identity, follower.timesLed())
+	}
+}
+
+func TestRunWithLeaderElectionHoldsLeaseUntilRunReturns(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// The leader takes longer than the lease duration to flush
+	leader := startCandidate(t, client, "a", 2*time.Second)
+	defer leader.cancel()
+	waitFor(t, "a leader", leader.isLeading)
+	follower := startCandidate(t, client, "b", 0)
+	defer follower.cancel()
+
+	leader.cancel()
+	for leader.isLeading() {
+		if follower.isLeading() {
+			t.Fatal("Got both candidates leading while the leader flushes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-leader.done
+
+	// The lease is released once the leader is done
+	start := time.Now()
+	waitFor(t, "the handoff", follower.isLeading)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Handoff took %v, longer than the lease duration", elapsed)
+	}
+}
@@ -1,21 +1,52 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
-	log "k8s.io/klog"
+	log "k8s.io/klog/v2"
 
+	"github.com/event-exporter/enricher"
+	"github.com/event-exporter/filters"
+	"github.com/event-exporter/health"
 	"github.com/event-exporter/signals"
 )
 
 var (
 	kubeconfigPath string
 	apiServerAddr  string
+	configPath     string
+	metricsAddr    string
+	healthAddr     string
+
+	shutdownTimeout   time.Duration
+	aggregationWindow time.Duration
+	eventsAPI         string
+	watchNamespaces   string
+	fieldSelector     string
+	enrich            bool
+	cluster           clusterConfig
+
+	leaderElect    bool
+	leaderElection leaderElectionConfig
+
+	startupMode            string
+	checkpointFile         string
+	checkpointConfigMap    string
+	checkpointSaveInterval time.Duration
 )
 
 func newKubernetesClient(kubeconfigPath, apiServerAddr string) (kubernetes.Interface, error) {
@@ -28,40 +59,228 @@ func newKubernetesClient(kubeconfigPath, apiServerAddr string) (kubernetes.Inter
 }
 
 func init() {
+	// klog reads its flags, e.g. -v, from the command line
+	log.InitFlags(nil)
+
 	flag.StringVar(&apiServerAddr, "apiServerAddr", "", "The address of the Kubernetes API server (overrides any value in kubeconfig).")
 	flag.StringVar(&kubeconfigPath, "kubeconfigPath", "", "Path to kubeconfig file with authorization and master location information.")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML config file with event filters and routes.")
+	flag.StringVar(&metricsAddr, "metricsAddr", ":9102", "Address to serve Prometheus metrics on at /metrics, empty to disable.")
+	flag.StringVar(&healthAddr, "healthAddr", ":8081", "Address to serve the /healthz and /readyz probes on, empty to disable.")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 20*time.Second, "Maximum duration to wait on shutdown for the sinks to flush their buffered events.")
+	flag.StringVar(&eventsAPI, "eventsAPI", eventsAPICore, "Events API to watch: core/v1 or events.k8s.io/v1. Events of either are exported as core/v1 Events.")
+	flag.StringVar(&watchNamespaces, "namespaces", "", "Comma separated namespaces to watch events in, with one informer each, empty to watch every namespace.")
+	flag.StringVar(&fieldSelector, "fieldSelector", "", "Field selector applied by the API server to the watched events, e.g. type=Warning.")
+	flag.BoolVar(&enrich, "enrich", false, "Attach the labels, annotations, owners and node of the involved object to every event, which watches Pods, Nodes, ReplicaSets, Deployments and Jobs.")
+	flag.StringVar(&cluster.name, "clusterName", "", "Name of the cluster, attached to every event.")
+	flag.StringVar(&cluster.region, "clusterRegion", "", "Region of the cluster, attached to every event, defaults to the AWS_REGION Env variable.")
+	flag.StringVar(&cluster.account, "clusterAccount", "", "Account of the cluster, attached to every event.")
+	flag.StringVar(&cluster.environment, "clusterEnvironment", "", "Environment of the cluster, e.g. production, attached to every event.")
+	flag.StringVar(&cluster.labels, "clusterLabels", "", "Comma separated key=value pairs attached to every event.")
+	flag.BoolVar(&cluster.discoverID, "clusterIDFromKubeSystem", false, "Attach the UID of the kube-system namespace to every event as the cluster ID.")
+	flag.DurationVar(&aggregationWindow, "aggregationWindow", 0, "Window within which the records of an event with the same involved object and reason are coalesced into one, 0 disables aggregation.")
+
+	hostname, _ := os.Hostname()
+	flag.BoolVar(&leaderElect, "leaderElect", false, "Elect a leader among the replicas through a Lease, only the leader exports events.")
+	flag.StringVar(&leaderElection.namespace, "leaderElectionNamespace", "kube-system", "Namespace of the leader election Lease.")
+	flag.StringVar(&leaderElection.name, "leaderElectionName", "event-exporter", "Name of the leader election Lease.")
+	flag.StringVar(&leaderElection.identity, "leaderElectionIdentity", hostname, "Identity of this replica in the leader election, defaults to the hostname.")
+	flag.DurationVar(&leaderElection.leaseDuration, "leaseDuration", 15*time.Second, "Duration non-leaders wait after the last renewal before taking over the lease.")
+	flag.DurationVar(&leaderElection.renewDeadline, "renewDeadline", 10*time.Second, "Duration the leader retries renewing the lease before giving up leadership.")
+	flag.DurationVar(&leaderElection.retryPeriod, "retryPeriod", 2*time.Second, "Duration between attempts to acquire or renew the lease.")
+
+	flag.StringVar(&startupMode, "startupMode", startupModeReplayAll, "What to do with the events already in the cluster on startup: replay-all, skip-initial-list or resume-from-checkpoint.")
+	flag.StringVar(&checkpointFile, "checkpointFile", "", "Path of the file the checkpoint is kept in for resume-from-checkpoint.")
+	flag.StringVar(&checkpointConfigMap, "checkpointConfigMap", "", "namespace/name of the ConfigMap the checkpoint is kept in for resume-from-checkpoint.")
+	flag.DurationVar(&checkpointSaveInterval, "checkpointSaveInterval", 10*time.Second, "Duration between saves of the checkpoint.")
+}
+
+// newCheckpointStore returns the checkpoint store configured by the flags,
+// or nil if there is none
+func newCheckpointStore(client kubernetes.Interface) (checkpointStore, error) {
+	switch {
+	case checkpointFile != "" && checkpointConfigMap != "":
+		return nil, fmt.Errorf("only one of -checkpointFile and -checkpointConfigMap may be set")
+	case checkpointFile != "":
+		return &fileCheckpointStore{path: checkpointFile}, nil
+	case checkpointConfigMap != "":
+		parts := strings.SplitN(checkpointConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid -checkpointConfigMap %q, expected namespace/name", checkpointConfigMap)
+		}
+		return &configMapCheckpointStore{client: client, namespace: parts[0], name: parts[1]}, nil
+	}
+	return nil, nil
+}
+
+// namespacesToWatch returns the namespaces listed by -namespaces, or
+// metav1.NamespaceAll if there are none
+func namespacesToWatch() []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, ns := range strings.Split(watchNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" && !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return namespaces
+}
+
+// newEventInformerFactories returns an informer factory for each namespace,
+// whose list and watch requests apply -fieldSelector. Every request beats the
+// heartbeat of the namespace, see informerStallTimeout.
+func newEventInformerFactories(client kubernetes.Interface, namespaces []string) []informers.SharedInformerFactory {
+	var factories []informers.SharedInformerFactory
+	for _, ns := range namespaces {
+		name := "event informer"
+		if ns != metav1.NamespaceAll {
+			name = fmt.Sprintf("event informer %s", ns)
+		}
+		watchHeartbeat := health.NewHeartbeat(name, informerStallTimeout)
+		factories = append(factories, informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithNamespace(ns),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fieldSelector
+				watchHeartbeat.Beat()
+			})))
+	}
+	return factories
+}
+
+// serve serves handler on addr, what names the handler in the logs
+func serve(what string, addr string, handler http.Handler) {
+	log.Infof("Serving %s on %s", what, addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Fatalf("Failed to serve %s: %v", what, err)
+	}
 }
 
 func main() {
 	flag.Set("logtostderr", "true")
 	defer log.Flush()
+
+	// Global flags such as -v come before the replay command
 	flag.Parse()
+	if configPath != "" {
+		viper.SetConfigFile(configPath)
+		if err := viper.ReadInConfig(); err != nil {
+			log.Fatal("Failed to read config file: ", err)
+		}
+	}
+	if flag.Arg(0) == replayCommand {
+		if err := runReplay(flag.Args()[1:]); err != nil {
+			log.Errorf("Replay failed: %v", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if _, err := fields.ParseSelector(fieldSelector); err != nil {
+		log.Fatal("Invalid field selector: ", err)
+	}
+	filter, err := filters.NewFromConfig("filter")
+	if err != nil {
+		log.Fatal("Failed to load event filter: ", err)
+	}
+	routes, err := filters.RoutesFromConfig("routes")
+	if err != nil {
+		log.Fatal("Failed to load routes: ", err)
+	}
+
 	client, err := newKubernetesClient(kubeconfigPath, apiServerAddr)
 
 	if err != nil {
 		log.Fatal("Failed to initialize Kubernetes client: ", err)
 	}
+	clusterMetadata, err := newClusterMetadata(client, cluster)
+	if err != nil {
+		log.Fatal("Failed to load cluster metadata: ", err)
+	}
 
-	sharedInformers := informers.NewSharedInformerFactory(client, 0)
-	eventsInformer := sharedInformers.Core().V1().Events()
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go serve("metrics", metricsAddr, mux)
+	}
+	if healthAddr != "" {
+		go serve("health probes", healthAddr, health.Handler())
+	}
 
-	eventExporter := newEventRouter(client, eventsInformer)
 	stopCh := signals.SigHandler()
-
-	if err != nil {
-		log.Errorf("Error: %v", err)
-	}
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		defer wg.Done()
-		eventExporter.Run(stopCh)
+		<-stopCh
+		cancel()
 	}()
 
-	// Startup the Informer(s)
-	log.Infof("Starting shared Informer(s)")
-	sharedInformers.Start(stopCh)
-	wg.Wait()
-	log.Warningf("Exiting main()")
-	os.Exit(1)
+	var runErr error
+	run := func(ctx context.Context) {
+		stopCh := ctx.Done()
+		namespaces := namespacesToWatch()
+		sharedInformers := newEventInformerFactories(client, namespaces)
+		source, err := newEventSource(sharedInformers, eventsAPI)
+		if err != nil {
+			log.Fatal("Invalid events API: ", err)
+		}
+
+		store, err := newCheckpointStore(client)
+		if err != nil {
+			log.Fatal("Invalid checkpoint: ", err)
+		}
+		startup, err := newStartupPolicy(startupMode, store, checkpointSaveInterval)
+		if err != nil {
+			log.Fatal("Invalid startup mode: ", err)
+		}
+
+		var eventEnricher *enricher.Enricher
+		if enrich {
+			// Separate from sharedInformers, whose requests beat the event
+			// informer heartbeats and apply the field selector
+			var enricherInformers []informers.SharedInformerFactory
+			for _, ns := range namespaces {
+				enricherInformers = append(enricherInformers, informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(ns)))
+			}
+			eventEnricher = enricher.New(enricherInformers...)
+			for _, factory := range enricherInformers {
+				factory.Start(stopCh)
+			}
+		}
+		eventExporter := newEventRouter(client, source, filter, routes, eventEnricher, clusterMetadata, aggregationWindow, startup, shutdownTimeout)
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runErr = eventExporter.Run(stopCh)
+		}()
+
+		// Startup the Informer(s)
+		log.Infof("Starting shared Informer(s)")
+		for _, factory := range sharedInformers {
+			factory.Start(stopCh)
+		}
+		wg.Wait()
+	}
+
+	if !leaderElect {
+		run(ctx)
+	} else {
+		if err := runWithLeaderElection(ctx, client, leaderElection, run); err != nil {
+			log.Fatal("Failed to start leader election: ", err)
+		}
+		if ctx.Err() == nil {
+			log.Fatalf("Lost lease %s/%s", leaderElection.namespace, leaderElection.name)
+		}
+	}
+	if runErr != nil {
+		log.Errorf("Failed to shut down cleanly: %v", runErr)
+		log.Flush()
+		os.Exit(1)
+	}
+	log.Infof("Exiting main()")
 }
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "event_exporter"
+
+var (
+	// EventsReceived counts the events delivered by the informer, by verb
+	EventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_received_total",
+		Help:      "Number of events received from the API server, by verb.",
+	}, []string{"verb"})
+
+	// EventsSkipped counts the events not exported because they were
+	// exported before the exporter restarted
+	EventsSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_skipped_total",
+		Help:      "Number of events skipped because they were exported before a restart.",
+	})
+
+	// EventsFiltered counts the events dropped by the filter
+	EventsFiltered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_filtered_total",
+		Help:      "Number of events dropped by the filter.",
+	})
+
+	// EventsCoalesced counts the event records merged into an earlier record
+	// of the same event by the aggregation
+	EventsCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_coalesced_total",
+		Help:      "Number of event records merged into an earlier record by the aggregation.",
+	})
+
+	// EventsExported counts the events successfully written by each sink
+	EventsExported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_exported_total",
+		Help:      "Number of events exported, by sink.",
+	}, []string{"sink"})
+
+	// ExportFailures counts the failed export attempts of each sink, by error
+	// code, e.g. InvalidSequenceTokenException or the HTTP status
+	ExportFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_failures_total",
+		Help:      "Number of failed export attempts, by sink and error code.",
+	}, []string{"sink", "code"})
+
+	// EventsDropped counts the events discarded because a sink buffer was full
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped_total",
+		Help:      "Number of events discarded because the sink buffer was full, by sink.",
+	}, []string{"sink"})
+
+	// EventsFailed counts the events a sink gave up on after failing to
+	// export them, without a dead letter file to write them to
+	EventsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_failed_total",
+		Help:      "Number of events lost because their export failed and they could not be dead lettered, by sink.",
+	}, []string{"sink"})
+
+	// EventsDeadLettered counts the events a sink wrote to its dead letter
+	// file after failing to export them
+	EventsDeadLettered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dead_lettered_total",
+		Help:      "Number of events written to the dead letter file after failed exports, by sink.",
+	}, []string{"sink"})
+
+	// BatchSize observes the number of events sent in a single request
+	BatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_size_events",
+		Help:      "Number of events sent in a single request, by sink.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"sink"})
+
+	// PutLogEventsDuration observes the latency of CloudWatch PutLogEvents calls
+	PutLogEventsDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cloudwatch_put_log_events_duration_seconds",
+		Help:      "Latency of CloudWatch Logs PutLogEvents calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		EventsReceived,
+		EventsSkipped,
+		EventsFiltered,
+		EventsCoalesced,
+		EventsExported,
+		ExportFailures,
+		EventsDropped,
+		EventsFailed,
+		EventsDeadLettered,
+		BatchSize,
+		PutLogEventsDuration,
+	)
+}
+
+// RegisterBufferLength registers a gauge reporting the number of events
+// waiting in a buffer of the sink. buffer tells the buffers of the same sink
+// apart. Registering the same buffer again replaces the gauge.
+func RegisterBufferLength(sink string, buffer string, length func() int) {
+	register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "buffered_events",
+		Help:        "Number of events waiting in a sink buffer.",
+		ConstLabels: prometheus.Labels{"sink": sink, "buffer": buffer},
+	}, func() float64 {
+		return float64(length())
+	}))
+}
+
+// RegisterRouteMatches registers a counter reporting the number of events
+// matched by a route. Registering the same route again replaces the counter.
+func RegisterRouteMatches(route string, matched func() uint64) {
+	register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "route_matched_events_total",
+		Help:        "Number of events matched by a route.",
+		ConstLabels: prometheus.Labels{"route": route},
+	}, func() float64 {
+		return float64(matched())
+	}))
+}
+
+// register registers the collector, replacing the one registered before with
+// the same name and labels, e.g. when the sinks are built again. Other errors
+// are bugs and panic like prometheus.MustRegister.
+func register(c prometheus.Collector) {
+	err := prometheus.Register(c)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		prometheus.Unregister(are.ExistingCollector)
+		err = prometheus.Register(c)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
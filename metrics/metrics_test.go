@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gathered returns the value of the metric with the given name and label,
+// and whether it was found
+func gathered(t *testing.T, name string, label string, value string) (float64, bool) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if hasLabel(m, label, value) {
+				if m.GetGauge() != nil {
+					return m.GetGauge().GetValue(), true
+				}
+				return m.GetCounter().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasLabel(m *dto.Metric, name string, value string) bool {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegisterBufferLengthTwice(t *testing.T) {
+	RegisterBufferLength("test", "sink", func() int { return 1 })
+	RegisterBufferLength("test", "sink", func() int { return 2 })
+	if got, ok := gathered(t, "event_exporter_buffered_events", "sink", "test"); !ok || got != 2 {
+		t.Errorf("Got buffered events %v (found %v), want 2 of the latest buffer", got, ok)
+	}
+}
+
+func TestRegisterRouteMatchesTwice(t *testing.T) {
+	RegisterRouteMatches("test", func() uint64 { return 1 })
+	RegisterRouteMatches("test", func() uint64 { return 2 })
+	if got, ok := gathered(t, "event_exporter_route_matched_events_total", "route", "test"); !ok || got != 2 {
+		t.Errorf("Got route matches %v (found %v), want 2 of the latest route", got, ok)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/signals"
+	"github.com/event-exporter/sinks"
+)
+
+// replayCommand is the name of the subcommand replaying exported events
+const replayCommand = "replay"
+
+// maxReplayLineSize is the longest line of event data replay accepts
+const maxReplayLineSize = 16 * 1024 * 1024
+
+// runReplay implements the replay command. It reads JSON lines of event data,
+// as written by the logfile sink in json format or by the dead letter files,
+// and exports them through the sinks configured by the SINK Env variable.
+// args are the arguments following the command, the global flags are parsed
+// before.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet(replayCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [global flags] %s [flags] FILE...\n\n", os.Args[0], replayCommand)
+		fmt.Fprintf(flags.Output(), "Exports the event data in the JSON lines FILEs, - for stdin, through the sinks\nconfigured by the SINK Env variable. Files ending in .gz are decompressed.\n\n")
+		flags.PrintDefaults()
+	}
+	flushTimeout := flags.Duration("flushTimeout", 5*time.Minute, "Maximum duration to wait for the sinks to export the replayed events once all files are read.")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no files to replay")
+	}
+
+	// Replayed events must not be dropped because the sinks cannot keep up,
+	// nor be left behind in a disk queue, and they keep their original
+	// timestamps. Failing events are not dead lettered, they would be
+	// appended to the files being replayed.
+	viper.Set("sinkDiscardMessages", false)
+	viper.Set("sinkQueueDir", "")
+	viper.Set("sinkDeadLetterDir", "")
+	viper.Set("cwlEventTimestamps", true)
+
+	ctx, stopSinks := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	sink := sinks.ManufactureSink(ctx, &wg)
+
+	stopCh := signals.SigHandler()
+	var replayed, skipped int
+	var err error
+	for _, path := range flags.Args() {
+		var n, s int
+		n, s, err = replayFile(path, sink, stopCh)
+		replayed += n
+		skipped += s
+		if err != nil {
+			err = fmt.Errorf("failed to replay %s: %v", path, err)
+			break
+		}
+	}
+	log.Infof("Replayed %d events, skipped %d invalid lines", replayed, skipped)
+
+	log.Infof("Flushing sinks")
+	stopSinks()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("Flushed sinks")
+	case <-time.After(*flushTimeout):
+		// An error replaying the files is the one worth reporting
+		if err != nil {
+			log.Warningf("Sinks did not flush within %v", *flushTimeout)
+			return err
+		}
+		return fmt.Errorf("sinks did not flush within %v", *flushTimeout)
+	}
+	return err
+}
+
+// replayFile hands every event in the JSON lines file at path to the sink,
+// until stopCh is closed. It returns the number of events replayed and of
+// lines skipped because they do not hold event data.
+func replayFile(path string, sink sinks.EventSinkInterface, stopCh <-chan struct{}) (replayed int, skipped int, err error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	log.Infof("Replaying %s", path)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		select {
+		case <-stopCh:
+			return replayed, skipped, fmt.Errorf("interrupted at line %d", line)
+		default:
+		}
+
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var eData sinks.EventData
+		if err := json.Unmarshal(data, &eData); err != nil || eData.Event == nil {
+			log.Warningf("Skipping line %d of %s, it is not event data", line, path)
+			skipped++
+			continue
+		}
+		sink.UpdateEvents(eData)
+		replayed++
+	}
+	return replayed, skipped, scanner.Err()
+}
@@ -5,7 +5,7 @@ import (
 	"os/signal"
 	"syscall"
 
-	log "k8s.io/klog"
+	log "k8s.io/klog/v2"
 )
 
 // SigHandler a signal hander to gracefully exit
@@ -2,9 +2,12 @@ package sinks
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"fmt"
 	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 	"unicode/utf8"
 
@@ -12,37 +15,86 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-	"github.com/eapache/channels"
-	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
-	log "k8s.io/klog"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
 )
 
 const perEventBytes = 26
-const maxMessageSize = 1046528
 const logStreamInactivityTimeout = time.Hour
 
+// PutLogEvents limits, see
+// https://docs.aws.amazon.com/AmazonCloudWatchLogs/latest/APIReference/API_PutLogEvents.html
+const (
+	maximumBytesPerPut     = 1048576
+	maximumLogEventsPerPut = 10000
+	maximumBytesPerEvent   = 262144 - perEventBytes
+	// maximumSpanPerPut is the longest time in milliseconds the events of a
+	// single call may span
+	maximumSpanPerPut = int64(24 * time.Hour / time.Millisecond)
+)
+
 /*
-CWLSink is the sink that uploads the kubernetes events as json object stored in a file.
-The sinker uploads it to CloudWatch Logs if any of the below criteria gets fullfilled
-1) Time(uploadInterval): If the specfied time has passed since the last upload it uploads
-2) [TODO] Data size: If the total data getting uploaded becomes greater than N bytes
+CWLSink is the sink that uploads the kubernetes events as json objects to CloudWatch Logs.
+Events are buffered per log stream and the sinker uploads a stream's buffer if any of the
+below criteria gets fullfilled
+1) Time(uploadInterval): Every uploadInterval all buffered events are uploaded
+2) Data size: If the batch would grow beyond the PutLogEvents limits of 1,048,576 bytes
+or 10,000 events it is uploaded first, so larger batches are split into several calls.
+Messages larger than the 256 KB per event limit are truncated.
+Failed uploads are retried according to the retry policy, after which the
+batch is written to the dead letter file if there is one.
 */
 type CWLSink struct {
 	//client from aws which makes the API call to CWL
 	client        LogsClient
 	logGroupName  string
 	logStreamName string
-	streams       map[string]*logStream
 
-	// lastUploadTimestamp stores the timestamp when the last upload to CWL happened
-	lastUploadTimestamp int64
+	// logStreamTemplate renders the log stream name of each event if the
+	// configured log stream name is a template, nil otherwise
+	logStreamTemplate *template.Template
 
-	// uploadInterval tells after how many seconds the next upload can happen
-	// sink waits till this time is passed before next upload can happen
+	// streams holds the buffered events and sequence token of each log stream
+	streams map[string]*logStream
+
+	// uploadInterval tells how often the buffered events are uploaded
 	uploadInterval time.Duration
+
+	// eventTimestamps stamps the log events with the time of the kubernetes
+	// event instead of the time they are received, see EventTimestamp
+	eventTimestamps bool
+
+	// autoCreate creates the log group and log streams when they do not exist,
+	// applying retentionInDays and kmsKeyID to a newly created log group
+	autoCreate      bool
+	retentionInDays int64
+	kmsKeyID        string
+	// retentionApplied is set once the retention has been applied to the
+	// current log group, guarded by logGroupMu as Check creates it as well
+	retentionApplied bool
+	logGroupMu       sync.Mutex
+
 	// eventCh is used to interact eventRouter and the sharedInformer
-	eventCh channels.Channel
+	eventCh *eventChannel
+	// failedEvents are the events of the uploads that have failed since the
+	// last flushAll and were not dead lettered, failedErr is the error of the
+	// last of them. uploaded is set when an upload has succeeded since.
+	failedEvents []EventData
+	failedErr    error
+	uploaded     bool
+
+	// retry decides how failed uploads are retried, deadLetter keeps the
+	// events of the uploads that failed for good
+	retry      *RetryPolicy
+	deadLetter *deadLetter
+
+	// template renders the log event messages, nil for JSON
+	template *messageTemplate
+
+	heartbeat *health.Heartbeat
 
 	// bodyBuf stores all the event captured data in a buffer before upload
 	bodyBuf *bytes.Buffer
@@ -51,37 +103,90 @@ type CWLSink struct {
 // LogsClient contains the CloudWatch API calls used by this plugin
 type LogsClient interface {
 	PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error)
+	CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+	PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
+}
+
+// logStreamNameData is the root object of the log stream name template. It
+// exposes the fields of the event, e.g. {{.Namespace}}, the verb and the
+// cluster metadata, e.g. {{.Cluster.Name}}.
+type logStreamNameData struct {
+	*v1.Event
+	Verb    string
+	Cluster ClusterMetadata
+}
+
+// defaultLogStreamName is used for events whose templated log stream name
+// cannot be rendered
+const defaultLogStreamName = "default"
+
+var logStreamNameReplacer = strings.NewReplacer(":", "_", "*", "_")
+
+// logStreamNameFuncs are the functions available to log stream name templates
+var logStreamNameFuncs = template.FuncMap{
+	// date returns the current UTC date, e.g. 2006-01-02
+	"date": func() string {
+		return time.Now().UTC().Format("2006-01-02")
+	},
+}
+
+// newLogStreamTemplate parses the log stream name as a template if it
+// contains an action, otherwise it returns nil
+func newLogStreamTemplate(logStreamName string) (*template.Template, error) {
+	if !strings.Contains(logStreamName, "{{") {
+		return nil, nil
+	}
+	t, err := template.New("logStreamName").Funcs(logStreamNameFuncs).Option("missingkey=zero").Parse(logStreamName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log stream name template %q: %v", logStreamName, err)
+	}
+	return t, nil
 }
 
 type logStream struct {
-	logEvents         []*cloudwatchlogs.InputLogEvent
+	logEvents []*cloudwatchlogs.InputLogEvent
+	// events holds the event data of logEvents, not necessarily in the same
+	// order, for the dead letter file
+	events            []EventData
 	currentByteLength int
+	// oldestTimestamp and newestTimestamp bound the timestamps of logEvents
+	oldestTimestamp   int64
+	newestTimestamp   int64
 	nextSequenceToken *string
 	logStreamName     string
 	expiration        time.Time
 }
 
-// NewCWLSink is the factory method constructing a new S3Sink
-func NewCWLSink(logGroupName string, logStreamName string, uploadInterval int, overflow bool, bufferSize int) (*CWLSink, error) {
+// NewCWLSink is the factory method constructing a new CWLSink
+func NewCWLSink(logGroupName string, logStreamName string, uploadInterval int, retry *RetryPolicy, overflow bool, bufferSize int) (*CWLSink, error) {
+	if uploadInterval <= 0 {
+		return nil, fmt.Errorf("upload interval must be positive, got %d", uploadInterval)
+	}
+
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
 	client := cloudwatchlogs.New(sess)
 
-	cwl := &CWLSink{
-		logGroupName:   logGroupName,
-		logStreamName:  logStreamName,
-		client:         client,
-		uploadInterval: time.Second * time.Duration(uploadInterval),
-		streams:        make(map[string]*logStream),
-		bodyBuf:        bytes.NewBuffer(make([]byte, 0, 4096)),
+	logStreamTemplate, err := newLogStreamTemplate(logStreamName)
+	if err != nil {
+		return nil, err
 	}
 
-	if overflow {
-		cwl.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
-	} else {
-		cwl.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	cwl := &CWLSink{
+		logGroupName:      logGroupName,
+		logStreamName:     logStreamName,
+		logStreamTemplate: logStreamTemplate,
+		client:            client,
+		uploadInterval:    time.Second * time.Duration(uploadInterval),
+		retry:             retry,
+		streams:           make(map[string]*logStream),
+		bodyBuf:           bytes.NewBuffer(make([]byte, 0, 4096)),
+		eventCh:           newEventChannel(cwlSinkName, "sink", overflow, bufferSize),
+		heartbeat:         newSinkHeartbeat(cwlSinkName),
 	}
 
 	return cwl, nil
@@ -89,100 +194,196 @@ func NewCWLSink(logGroupName string, logStreamName string, uploadInterval int, o
 
 // UpdateEvents implements the EventSinkInterface. It really just writes the
 // event data to the event OverflowingChannel, which should never block.
-// Messages that are buffered beyond the bufferSize specified for this HTTPSink
+// Messages that are buffered beyond the bufferSize specified for this CWLSink
 // are discarded.
-func (cwl *CWLSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
-	cwl.eventCh.In() <- NewEventData(eNew, eOld)
+func (cwl *CWLSink) UpdateEvents(eData EventData) {
+	cwl.eventCh.send(eData)
 }
 
-// Run sits in a loop, waiting for data to come in through h.eventCh,
-// and forwarding them to the HTTP sink. If multiple events have happened
-// between loop iterations, it puts all of them in one request instead of
-// making a single request per event.
-func (cwl *CWLSink) Run(stopCh <-chan bool) {
-loop:
+// Run sits in a loop, waiting for data to come in through cwl.eventCh and
+// adding them to the buffer of their log stream. Every uploadInterval the
+// buffered events of all streams are uploaded, so events arriving shortly
+// after an upload wait for the next one instead of being lost. When ctx is
+// done the remaining events are uploaded before Run returns.
+func (cwl *CWLSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(cwl.uploadInterval)
+	defer ticker.Stop()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
 	for {
 		select {
 		case e := <-cwl.eventCh.Out():
-			var evt EventData
-			var ok bool
-			if evt, ok = e.(EventData); !ok {
-				glog.Warningf("Invalid type sent through event channel: %T", e)
-				continue loop
+			evt, ok := cwl.eventCh.event(e)
+			if !ok {
+				continue
 			}
-
-			// Start with just this event...
-			arr := []EventData{evt}
-
-			// Consume all buffered events into an array, in case more have been written
-			// since we last forwarded them
-			numEvents := cwl.eventCh.Len()
-			for i := 0; i < numEvents; i++ {
-				e := <-cwl.eventCh.Out()
-				if evt, ok = e.(EventData); ok {
-					arr = append(arr, evt)
-				} else {
-					glog.Warningf("Invalid type sent through event channel: %T", e)
-				}
+			cwl.addEvent(ctx, evt)
+		case <-ticker.C:
+			cwl.flushAll(ctx)
+		case <-heartbeatTicker.C:
+			cwl.heartbeat.Beat()
+		case <-ctx.Done():
+			for _, evt := range cwl.eventCh.drain() {
+				cwl.addEvent(ctx, evt)
 			}
-
-			cwl.drainEvents(arr)
-		case <-stopCh:
-			break loop
+			cwl.flushAll(ctx)
+			cwl.eventCh.close()
+			cwl.deadLetter.close()
+			return
 		}
 	}
 }
 
-// drainEvents takes an array of event data and sends it to s3
-func (cwl *CWLSink) drainEvents(events []EventData) {
+// addEvent adds the event to the buffer of its log stream, uploading the
+// buffer first if the event would not fit into the same PutLogEvents call
+func (cwl *CWLSink) addEvent(ctx context.Context, evt EventData) {
+	formatted, err := cwl.template.format(&evt)
+	if err != nil {
+		metrics.ExportFailures.WithLabelValues(cwlSinkName, "format").Inc()
+		log.Warningf("Failed to format event %s/%s, skipping it: %v", evt.Event.Namespace, evt.Event.Name, err)
+		return
+	}
+	message := string(formatted)
+	if effectiveLen(message) > maximumBytesPerEvent {
+		log.Warningf("Event %s/%s is larger than %d bytes, truncating it", evt.Event.Namespace, evt.Event.Name, maximumBytesPerEvent)
+		message = truncateMessage(message, maximumBytesPerEvent)
+	}
 
 	timestamp := time.Now()
-	s := &logStream{
-		logStreamName: cwl.logStreamName,
+	if cwl.eventTimestamps {
+		if t := EventTimestamp(evt.Event); !t.IsZero() {
+			timestamp = t
+		}
 	}
+	// CloudWatch uses milliseconds since epoch
+	millis := timestamp.UnixNano() / 1e6
 
-	for _, evt := range events {
-		var messageSize int
-		eJSONBytes, err := json.Marshal(evt)
-		if err != nil {
-			glog.Warningf("Failed to flatten json: %v", err)
-			return
+	stream := cwl.getLogStream(cwl.renderLogStreamName(&evt))
+	if !stream.fits(message, millis) {
+		cwl.flush(ctx, stream)
+	}
+	stream.logEvents = append(stream.logEvents, &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(millis),
+	})
+	stream.events = append(stream.events, evt)
+	stream.currentByteLength += cloudwatchLen(message)
+	if len(stream.logEvents) == 1 || millis < stream.oldestTimestamp {
+		stream.oldestTimestamp = millis
+	}
+	if len(stream.logEvents) == 1 || millis > stream.newestTimestamp {
+		stream.newestTimestamp = millis
+	}
+}
+
+// getLogStream returns the log stream with the given name, creating it if
+// it is not tracked yet
+func (cwl *CWLSink) getLogStream(name string) *logStream {
+	stream, ok := cwl.streams[name]
+	if !ok {
+		stream = &logStream{
+			logStreamName: name,
 		}
-		messageSize += len(eJSONBytes)
-		//fmt.Println("size =====", messageSize)
-		s.logEvents = append(s.logEvents, &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(string(eJSONBytes)),
-			Timestamp: aws.Int64(timestamp.UnixNano() / 1e6), // CloudWatch uses milliseconds since epoch
-		})
-		s.currentByteLength += cloudwatchLen(string(eJSONBytes))
+		stream.updateExpiration()
+		cwl.streams[name] = stream
 	}
+	return stream
+}
 
-	if cwl.canUpload() == false {
-		return
+// flushAll uploads the buffered events of every log stream, and stops
+// tracking the streams that have not received events for
+// logStreamInactivityTimeout. If uploads failed since the last flushAll with
+// a retryable error, a disk backed eventCh delivers their events again: all
+// events since the last flushAll if none succeeded, otherwise only those of
+// the failed uploads are queued again, so the events of the healthy log
+// streams are not uploaded twice. Other failed events are given up on.
+func (cwl *CWLSink) flushAll(ctx context.Context) {
+	now := time.Now()
+	for name, stream := range cwl.streams {
+		cwl.flush(ctx, stream)
+		if len(stream.logEvents) == 0 && now.After(stream.expiration) {
+			log.V(2).Infof("Log stream %s is inactive, no longer tracking it", name)
+			delete(cwl.streams, name)
+		}
 	}
 
-	err := cwl.upload(s)
-	if err != nil {
-		log.Warning(err)
+	switch {
+	case cwl.failedErr == nil:
+		cwl.eventCh.ack()
+	case !cwl.uploaded && cwl.eventCh.redeliver(cwl.failedErr, len(cwl.failedEvents)):
+		log.Infof("Retrying the events of the failed uploads")
+	case cwl.uploaded && cwl.eventCh.requeue(cwl.failedErr, cwl.failedEvents):
+		log.Infof("Queueing %d events of failed uploads again", len(cwl.failedEvents))
+	default:
+		log.Warningf("Dropping %d events of failed uploads", len(cwl.failedEvents))
 	}
+	cwl.failedEvents, cwl.failedErr, cwl.uploaded = nil, nil, false
 }
 
-// canUpload verifies the conditions suitable for a new file upload and upload the data
-func (cwl *CWLSink) canUpload() bool {
-	now := time.Now().UnixNano()
-	if (cwl.lastUploadTimestamp + cwl.uploadInterval.Nanoseconds()) < now {
-		return true
+// renderLogStreamName returns the name of the log stream the event belongs to
+func (cwl *CWLSink) renderLogStreamName(evt *EventData) string {
+	if cwl.logStreamTemplate == nil {
+		return cwl.logStreamName
+	}
+
+	var name strings.Builder
+	data := logStreamNameData{Event: evt.Event, Verb: evt.Verb}
+	if evt.Cluster != nil {
+		data.Cluster = *evt.Cluster
+	}
+	if err := cwl.logStreamTemplate.Execute(&name, data); err != nil {
+		log.Warningf("Failed to render log stream name for event %s/%s: %v", evt.Event.Namespace, evt.Event.Name, err)
+		return defaultLogStreamName
+	}
+	// ':' and '*' are not allowed in log stream names
+	sanitized := logStreamNameReplacer.Replace(name.String())
+	if sanitized == "" {
+		return defaultLogStreamName
+	}
+	return sanitized
+}
+
+// flush uploads the buffered events of the log stream, retrying failed
+// uploads, and clears the buffer. If the upload fails for good the events are
+// written to the dead letter file.
+func (cwl *CWLSink) flush(ctx context.Context, stream *logStream) {
+	if len(stream.logEvents) == 0 {
+		return
+	}
+	err := cwl.retry.Do(ctx, cwlSinkName, func() error {
+		// Uploading every stream may take a while with retries, but each
+		// attempt is progress
+		cwl.heartbeat.Beat()
+		err := cwl.upload(stream)
+		if isResourceNotFound(err) && cwl.autoCreate {
+			log.Infof("Log group %s or log stream %s does not exist, creating it", cwl.logGroupName, stream.logStreamName)
+			if err = cwl.createLogGroup(); err == nil {
+				if err = cwl.ensureLogStream(stream); err == nil {
+					err = cwl.upload(stream)
+				}
+			}
+		}
+		return err
+	})
+	if err != nil {
+		log.Warningf("Failed to upload %d events to log stream %s: %v", len(stream.logEvents), stream.logStreamName, err)
+		if !cwl.deadLetter.writeEvents(stream.events) {
+			cwl.failedEvents = append(cwl.failedEvents, stream.events...)
+			cwl.failedErr = err
+		}
+	} else {
+		cwl.uploaded = true
 	}
-	return false
+	stream.reset()
 }
 
-// upload uploads the events stored in buffer to s3 in the specified key
+// upload uploads the buffered events of the log stream to CloudWatch Logs
 // and clears the buffer
 func (cwl *CWLSink) upload(stream *logStream) error {
 	// Reuse the body buffer for each request
 	cwl.bodyBuf.Truncate(0)
 
-	now := time.Now()
 	stream.updateExpiration()
 	// Log events in a single PutLogEvents request must be in chronological order.
 	sort.Slice(stream.logEvents, func(i, j int) bool {
@@ -190,21 +391,24 @@ func (cwl *CWLSink) upload(stream *logStream) error {
 	})
 
 	log.Infof("Uploading LogEvents to CloudWatch Logs...")
+	metrics.BatchSize.WithLabelValues(cwlSinkName).Observe(float64(len(stream.logEvents)))
+	start := time.Now()
 	response, err := cwl.client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
 		LogEvents:     stream.logEvents,
 		LogGroupName:  aws.String(cwl.logGroupName),
 		LogStreamName: aws.String(stream.logStreamName),
 		SequenceToken: stream.nextSequenceToken,
 	})
+	metrics.PutLogEventsDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		metrics.ExportFailures.WithLabelValues(cwlSinkName, awsErrorCode(err)).Inc()
 		if awsErr, ok := err.(awserr.Error); ok {
 			if awsErr.Code() == cloudwatchlogs.ErrCodeDataAlreadyAcceptedException {
 				// already submitted, just grab the correct sequence token
 				parts := strings.Split(awsErr.Message(), " ")
 				stream.nextSequenceToken = &parts[len(parts)-1]
-				stream.logEvents = stream.logEvents[:0]
-				stream.currentByteLength = 0
+				stream.reset()
 				log.Infof("[cloudwatch] Encountered error %v; data already accepted, ignoring error\n", awsErr)
 				return nil
 			} else if awsErr.Code() == cloudwatchlogs.ErrCodeInvalidSequenceTokenException {
@@ -221,22 +425,23 @@ func (cwl *CWLSink) upload(stream *logStream) error {
 		}
 	}
 	cwl.processRejectedEventsInfo(response)
-	cwl.lastUploadTimestamp = now.UnixNano()
-	stream.logEvents = stream.logEvents[:0]
+	metrics.EventsExported.WithLabelValues(cwlSinkName).Add(float64(len(stream.logEvents)))
+	stream.nextSequenceToken = response.NextSequenceToken
 	log.Infof("Uploaded to CloudWatch %v bytes", stream.currentByteLength)
+	stream.reset()
 	return nil
 }
 
 func (cwl *CWLSink) processRejectedEventsInfo(response *cloudwatchlogs.PutLogEventsOutput) {
 	if response.RejectedLogEventsInfo != nil {
 		if response.RejectedLogEventsInfo.ExpiredLogEventEndIndex != nil {
-			log.Warning("[cloudwatch] %d log events were marked as expired by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.ExpiredLogEventEndIndex))
+			log.Warningf("[cloudwatch] %d log events were marked as expired by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.ExpiredLogEventEndIndex))
 		}
 		if response.RejectedLogEventsInfo.TooNewLogEventStartIndex != nil {
-			log.Warning("[cloudwatch %d] %d log events were marked as too new by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.TooNewLogEventStartIndex))
+			log.Warningf("[cloudwatch] %d log events were marked as too new by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.TooNewLogEventStartIndex))
 		}
 		if response.RejectedLogEventsInfo.TooOldLogEventEndIndex != nil {
-			log.Warning("[cloudwatch] %d log events were marked as too old by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.TooOldLogEventEndIndex))
+			log.Warningf("[cloudwatch] %d log events were marked as too old by CloudWatch\n", aws.Int64Value(response.RejectedLogEventsInfo.TooOldLogEventEndIndex))
 		}
 	}
 }
@@ -258,76 +463,161 @@ func cloudwatchLen(event string) int {
 	return effectiveLen(event) + perEventBytes
 }
 
+// truncateMessage cuts the message so its effective length is at most max
+// bytes, without splitting a UTF-8 sequence
+func truncateMessage(message string, max int) string {
+	effectiveBytes := 0
+	for i, rune := range message {
+		effectiveBytes += utf8.RuneLen(rune)
+		if effectiveBytes > max {
+			return message[:i]
+		}
+	}
+	return message
+}
+
+// fits returns true if the message with the given timestamp can be added to
+// the stream without exceeding the limits of a single PutLogEvents call
+func (stream *logStream) fits(message string, timestamp int64) bool {
+	if len(stream.logEvents) == 0 {
+		return true
+	}
+	if timestamp-stream.oldestTimestamp > maximumSpanPerPut || stream.newestTimestamp-timestamp > maximumSpanPerPut {
+		return false
+	}
+	return len(stream.logEvents) < maximumLogEventsPerPut &&
+		stream.currentByteLength+cloudwatchLen(message) <= maximumBytesPerPut
+}
+
+func (stream *logStream) reset() {
+	stream.logEvents = stream.logEvents[:0]
+	stream.events = stream.events[:0]
+	stream.currentByteLength = 0
+}
+
 func (stream *logStream) updateExpiration() {
 	stream.expiration = time.Now().Add(logStreamInactivityTimeout)
 }
 
-/* ToDo auto create log group and log stream
-// CreateLogGroup
-func createLogGroup() (logGroupName string, err error) {
-	logGroup := "kubernetes/Event_Exporter_Log_Group"
-
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+// EnableAutoCreate makes the sink create its log group and log streams when
+// they do not exist, and creates them right away. A newly created log group
+// gets the given retention (if positive) and KMS key (if set). The retention
+// is applied once to an existing log group as well.
+func (cwl *CWLSink) EnableAutoCreate(retentionInDays int64, kmsKeyID string) error {
+	cwl.autoCreate = true
+	cwl.retentionInDays = retentionInDays
+	cwl.kmsKeyID = kmsKeyID
+
+	if err := cwl.createLogGroup(); err != nil {
+		return err
+	}
+	if cwl.logStreamTemplate != nil {
+		// Templated log streams are created on their first upload
+		return nil
+	}
+	return cwl.ensureLogStream(cwl.getLogStream(cwl.logStreamName))
+}
 
-	//session
-	client := cloudwatchlogs.New(sess)
+// createLogGroup creates the log group, it is not an error if it exists. The
+// retention is applied either way, unless it already has been.
+func (cwl *CWLSink) createLogGroup() error {
+	cwl.logGroupMu.Lock()
+	defer cwl.logGroupMu.Unlock()
 
-	//Input
-	logGroupNameInput := &cloudwatchlogs.CreateLogGroupInput{
-		LogGroupName: aws.String(logGroup),
+	input := &cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(cwl.logGroupName),
+	}
+	if cwl.kmsKeyID != "" {
+		input.KmsKeyId = aws.String(cwl.kmsKeyID)
 	}
-	//create
-	_, err = client.CreateLogGroup(logGroupNameInput)
 
+	_, err := cwl.client.CreateLogGroup(input)
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
-				return "", err
-			}
-			log.V(2).Infof("cloudwatch Log group already exists\n")
-		} else {
-			return "", err
+		awsErr, ok := err.(awserr.Error)
+		if !ok || awsErr.Code() != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+			return err
 		}
+		log.V(2).Infof("cloudwatch Log group %s already exists", cwl.logGroupName)
+	} else {
+		log.Infof("Created cloudwatch Log group %s", cwl.logGroupName)
+		cwl.retentionApplied = false
 	}
-	return logGroup, nil
+	return cwl.putRetentionPolicy()
 }
 
-func createLogStream(logGroupName string) (logStreamName string, err error) {
-
-	//generate UUID
-	id, err := uuid.NewRandom()
+// putRetentionPolicy applies the retention to the log group, if it has not
+// been applied yet
+func (cwl *CWLSink) putRetentionPolicy() error {
+	if cwl.retentionInDays <= 0 || cwl.retentionApplied {
+		return nil
+	}
+	_, err := cwl.client.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+		LogGroupName:    aws.String(cwl.logGroupName),
+		RetentionInDays: aws.Int64(cwl.retentionInDays),
+	})
 	if err != nil {
-		log.Exit("Unable to generate Unique ID")
+		return err
 	}
+	log.Infof("Applied a retention of %d days to cloudwatch Log group %s", cwl.retentionInDays, cwl.logGroupName)
+	cwl.retentionApplied = true
+	return nil
+}
 
-	logstreamOutputName := "eventData" + id.String()
-
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-
-	//session
-	client := cloudwatchlogs.New(sess)
-
-	//Input
-	logStreamNameInput := &cloudwatchlogs.CreateLogStreamInput{
-		LogGroupName:  aws.String(logGroupName),
-		LogStreamName: aws.String(logstreamOutputName),
+// ensureLogStream makes sure the log stream exists, picking up its sequence
+// token if it does and creating it if it does not
+func (cwl *CWLSink) ensureLogStream(stream *logStream) error {
+	response, err := cwl.client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(cwl.logGroupName),
+		LogStreamNamePrefix: aws.String(stream.logStreamName),
+	})
+	if err != nil {
+		return err
 	}
-	//create
-	_, err = client.CreateLogStream(logStreamNameInput)
+	for _, s := range response.LogStreams {
+		if aws.StringValue(s.LogStreamName) == stream.logStreamName {
+			stream.nextSequenceToken = s.UploadSequenceToken
+			return nil
+		}
+	}
+
+	_, err = cwl.client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(cwl.logGroupName),
+		LogStreamName: aws.String(stream.logStreamName),
+	})
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
-				return "", err
-			}
-			log.Infof("cloudwatch Log Stream %s already exists\n", logstreamOutputName)
-		} else {
-			return "", err
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+			log.V(2).Infof("cloudwatch Log stream %s already exists", stream.logStreamName)
+			return nil
 		}
+		return err
 	}
-	return logstreamOutputName, nil
+	log.Infof("Created cloudwatch Log stream %s", stream.logStreamName)
+	stream.nextSequenceToken = nil
+	return nil
+}
+
+// awsErrorCode returns the AWS error code of err, used to label failures
+func awsErrorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "unknown"
+}
+
+// Check implements the Checker interface. It makes sure the log group can be
+// reached, creating it if it does not exist and auto creation is enabled.
+func (cwl *CWLSink) Check() error {
+	_, err := cwl.client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: aws.String(cwl.logGroupName),
+		Limit:        aws.Int64(1),
+	})
+	if isResourceNotFound(err) && cwl.autoCreate {
+		return cwl.createLogGroup()
+	}
+	return err
+}
+
+func isResourceNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException
 }
-*/
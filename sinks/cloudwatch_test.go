@@ -0,0 +1,478 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/event-exporter/health"
+)
+
+// fakeLogsClient fails the uploads to the log streams in errors and records
+// the number of events uploaded to the others
+type fakeLogsClient struct {
+	mu       sync.Mutex
+	errors   map[string]error
+	uploaded map[string]int
+
+	// describeErr fails DescribeLogStreams until the log group is created
+	describeErr  error
+	groupCreated bool
+	// retentionPolicies counts the PutRetentionPolicy calls
+	retentionPolicies int
+}
+
+func (c *fakeLogsClient) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stream := aws.StringValue(input.LogStreamName)
+	if err := c.errors[stream]; err != nil {
+		return nil, err
+	}
+	c.uploaded[stream] += len(input.LogEvents)
+	return &cloudwatchlogs.PutLogEventsOutput{}, nil
+}
+
+func (c *fakeLogsClient) CreateLogGroup(*cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.groupCreated {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log group already exists", nil)
+	}
+	c.groupCreated = true
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (c *fakeLogsClient) CreateLogStream(*cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (c *fakeLogsClient) DescribeLogStreams(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.describeErr != nil && !c.groupCreated {
+		return nil, c.describeErr
+	}
+	return &cloudwatchlogs.DescribeLogStreamsOutput{}, nil
+}
+
+func (c *fakeLogsClient) PutRetentionPolicy(*cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retentionPolicies++
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+// newTestCWLSink returns a CWLSink with a log stream per namespace, buffering
+// in a disk queue
+func newTestCWLSink(t *testing.T, client LogsClient) *CWLSink {
+	q, err := newDiskQueue(t.TempDir(), cwlSinkName, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.close)
+	logStreamTemplate, err := newLogStreamTemplate("{{.Namespace}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CWLSink{
+		logGroupName:      "events",
+		logStreamTemplate: logStreamTemplate,
+		client:            client,
+		streams:           make(map[string]*logStream),
+		bodyBuf:           &bytes.Buffer{},
+		eventCh:           &eventChannel{sink: cwlSinkName, disk: q},
+		heartbeat:         health.NewHeartbeat("test "+cwlSinkName, time.Minute),
+	}
+}
+
+// receive adds the events delivered by the buffer to the log streams, until
+// none is delivered for a while, and returns how many there were
+func receive(cwl *CWLSink) int {
+	n := 0
+	for {
+		select {
+		case e := <-cwl.eventCh.Out():
+			if evt, ok := cwl.eventCh.event(e); ok {
+				cwl.addEvent(context.Background(), evt)
+				n++
+			}
+		case <-time.After(100 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+func TestCWLSinkFlushAll(t *testing.T) {
+	notFound := awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log stream does not exist.", nil)
+	unavailable := awserr.New(cloudwatchlogs.ErrCodeServiceUnavailableException, "The service is unavailable.", nil)
+
+	tests := []struct {
+		name       string
+		namespaces []string
+		errors     map[string]error
+		// wantRedelivered is the number of events delivered again after
+		// the first flushAll
+		wantRedelivered int
+		wantUploaded    map[string]int
+	}{
+		{
+			name:         "success",
+			namespaces:   []string{"a", "b", "a"},
+			wantUploaded: map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:         "drops a stream that does not exist",
+			namespaces:   []string{"ok", "missing", "ok"},
+			errors:       map[string]error{"missing": notFound},
+			wantUploaded: map[string]int{"ok": 2},
+		},
+		{
+			name:            "queues the events of a failed stream again",
+			namespaces:      []string{"ok", "down", "ok"},
+			errors:          map[string]error{"down": unavailable},
+			wantRedelivered: 1,
+			wantUploaded:    map[string]int{"ok": 2},
+		},
+		{
+			name:            "retries when every upload failed",
+			namespaces:      []string{"down", "down", "other"},
+			errors:          map[string]error{"down": unavailable, "other": unavailable},
+			wantRedelivered: 3,
+			wantUploaded:    map[string]int{},
+		},
+		{
+			name:         "drops when every upload failed for good",
+			namespaces:   []string{"missing", "missing"},
+			errors:       map[string]error{"missing": notFound},
+			wantUploaded: map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeLogsClient{errors: tt.errors, uploaded: make(map[string]int)}
+			cwl := newTestCWLSink(t, client)
+			for _, ns := range tt.namespaces {
+				cwl.UpdateEvents(EventData{Verb: "ADDED", Event: &v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "e"}}})
+			}
+			if n := receive(cwl); n != len(tt.namespaces) {
+				t.Fatalf("Got %d events, want %d", n, len(tt.namespaces))
+			}
+
+			// Flush a few times, as on every upload interval
+			var redelivered int
+			for i := 0; i < 3; i++ {
+				cwl.flushAll(context.Background())
+				n := receive(cwl)
+				if i == 0 {
+					redelivered = n
+				}
+			}
+			if redelivered != tt.wantRedelivered {
+				t.Errorf("Got %d events delivered again, want %d", redelivered, tt.wantRedelivered)
+			}
+			for stream, want := range tt.wantUploaded {
+				if got := client.uploaded[stream]; got != want {
+					t.Errorf("Got %d events uploaded to %s, want %d", got, stream, want)
+				}
+			}
+			if len(client.uploaded) != len(tt.wantUploaded) {
+				t.Errorf("Got uploads %v, want %v", client.uploaded, tt.wantUploaded)
+			}
+		})
+	}
+}
+
+func TestCWLSinkCheck(t *testing.T) {
+	notFound := awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	denied := awserr.New("AccessDeniedException", "Not authorized.", nil)
+
+	tests := []struct {
+		name        string
+		describeErr error
+		autoCreate  bool
+		wantErr     bool
+		wantCreated bool
+	}{
+		{name: "log group exists"},
+		{name: "log group missing", describeErr: notFound, wantErr: true},
+		{name: "log group created", describeErr: notFound, autoCreate: true, wantCreated: true},
+		{name: "not authorized", describeErr: denied, autoCreate: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeLogsClient{describeErr: tt.describeErr}
+			cwl := newTestCWLSink(t, client)
+			cwl.autoCreate = tt.autoCreate
+			err := cwl.Check()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Got error %v, want error %v", err, tt.wantErr)
+			}
+			if client.groupCreated != tt.wantCreated {
+				t.Errorf("Got log group created %v, want %v", client.groupCreated, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestCWLSinkUploadsQueuedEventsOnceStreamRecovers(t *testing.T) {
+	unavailable := awserr.New(cloudwatchlogs.ErrCodeServiceUnavailableException, "The service is unavailable.", nil)
+	client := &fakeLogsClient{errors: map[string]error{"down": unavailable}, uploaded: make(map[string]int)}
+	cwl := newTestCWLSink(t, client)
+	for _, ns := range []string{"ok", "down", "down"} {
+		cwl.UpdateEvents(EventData{Verb: "ADDED", Event: &v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "e"}}})
+	}
+	receive(cwl)
+	cwl.flushAll(context.Background())
+	if n := receive(cwl); n != 2 {
+		t.Fatalf("Got %d events queued again, want 2", n)
+	}
+
+	client.mu.Lock()
+	delete(client.errors, "down")
+	client.mu.Unlock()
+	cwl.flushAll(context.Background())
+	if n := receive(cwl); n != 0 {
+		t.Errorf("Got %d events delivered after the stream recovered, want none", n)
+	}
+	if want := map[string]int{"ok": 1, "down": 2}; len(client.uploaded) != 2 || client.uploaded["ok"] != 1 || client.uploaded["down"] != 2 {
+		t.Errorf("Got uploads %v, want %v", client.uploaded, want)
+	}
+}
+
+func TestCWLSinkAppliesRetentionOnce(t *testing.T) {
+	client := &fakeLogsClient{}
+	cwl := newTestCWLSink(t, client)
+	if err := cwl.EnableAutoCreate(7, ""); err != nil {
+		t.Fatal(err)
+	}
+	// The log group exists, e.g. on ResourceNotFoundException of a log stream
+	if err := cwl.createLogGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cwl.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if client.retentionPolicies != 1 {
+		t.Errorf("Got %d retention policies applied, want 1", client.retentionPolicies)
+	}
+
+	// A log group deleted and created again gets the retention again
+	client.groupCreated = false
+	if err := cwl.createLogGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if client.retentionPolicies != 2 {
+		t.Errorf("Got %d retention policies applied after creating the log group again, want 2", client.retentionPolicies)
+	}
+}
+
+func TestLogStreamFits(t *testing.T) {
+	day := maximumSpanPerPut
+	tests := []struct {
+		name      string
+		events    int
+		bytes     int
+		oldest    int64
+		newest    int64
+		message   int
+		timestamp int64
+		want      bool
+	}{
+		{name: "empty stream", message: maximumBytesPerEvent, want: true},
+		{name: "below the event limit", events: maximumLogEventsPerPut - 1, bytes: 100, message: 1, want: true},
+		{name: "at the event limit", events: maximumLogEventsPerPut, bytes: 100, message: 1, want: false},
+		{name: "up to the byte limit", events: 1, bytes: maximumBytesPerPut - perEventBytes - 10, message: 10, want: true},
+		{name: "one byte over the byte limit", events: 1, bytes: maximumBytesPerPut - perEventBytes - 10, message: 11, want: false},
+		{name: "spanning a day", events: 1, bytes: 100, oldest: 0, newest: 0, message: 1, timestamp: day, want: true},
+		{name: "spanning more than a day", events: 1, bytes: 100, oldest: 0, newest: 0, message: 1, timestamp: day + 1, want: false},
+		{name: "older by a day", events: 1, bytes: 100, oldest: day, newest: day, message: 1, timestamp: 0, want: true},
+		{name: "older by more than a day", events: 1, bytes: 100, oldest: day + 1, newest: day + 1, message: 1, timestamp: 0, want: false},
+		{name: "between the oldest and newest", events: 2, bytes: 100, oldest: 0, newest: day, message: 1, timestamp: day / 2, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &logStream{
+				logEvents:         make([]*cloudwatchlogs.InputLogEvent, tt.events),
+				currentByteLength: tt.bytes,
+				oldestTimestamp:   tt.oldest,
+				newestTimestamp:   tt.newest,
+			}
+			if got := stream.fits(strings.Repeat("a", tt.message), tt.timestamp); got != tt.want {
+				t.Errorf("Got fits %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		max     int
+		want    string
+	}{
+		{"shorter", "abc", 4, "abc"},
+		{"at the limit", "abcd", 4, "abcd"},
+		{"one byte over", "abcde", 4, "abcd"},
+		{"does not split a rune", "ab\u00e9", 3, "ab"},
+		{"keeps a whole rune", "ab\u00e9", 4, "ab\u00e9"},
+		// Invalid bytes count as the 3 bytes of the replacement character
+		{"invalid UTF-8", "a\xffb", 4, "a\xff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateMessage(tt.message, tt.max); got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCWLSinkAddEventSplitsBatches(t *testing.T) {
+	template, err := newMessageTemplate(cwlSinkName, "{{.Event.Message}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		events       int
+		message      int
+		wantUploaded int
+	}{
+		{"by event count", maximumLogEventsPerPut + 1, 1, maximumLogEventsPerPut},
+		// 4 of the largest events add up to exactly the byte limit
+		{"by size", 5, maximumBytesPerEvent, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeLogsClient{uploaded: make(map[string]int)}
+			cwl := newTestCWLSink(t, client)
+			cwl.logStreamTemplate = nil
+			cwl.logStreamName = "events"
+			cwl.template = template
+
+			evt := EventData{Verb: "ADDED", Event: &v1.Event{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "e"},
+				Message:    strings.Repeat("a", tt.message),
+			}}
+			for i := 0; i < tt.events; i++ {
+				cwl.addEvent(context.Background(), evt)
+			}
+			if got := client.uploaded["events"]; got != tt.wantUploaded {
+				t.Errorf("Got %d events uploaded, want a full batch of %d", got, tt.wantUploaded)
+			}
+			if got := len(cwl.streams["events"].logEvents); got != tt.events-tt.wantUploaded {
+				t.Errorf("Got %d events buffered, want %d", got, tt.events-tt.wantUploaded)
+			}
+		})
+	}
+}
+
+func TestCWLSinkAddEventTruncates(t *testing.T) {
+	cwl := newTestCWLSink(t, &fakeLogsClient{uploaded: make(map[string]int)})
+	template, err := newMessageTemplate(cwlSinkName, "{{.Event.Message}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwl.template = template
+
+	for _, size := range []int{maximumBytesPerEvent, maximumBytesPerEvent + 1} {
+		evt := EventData{Verb: "ADDED", Event: &v1.Event{
+			ObjectMeta: metav1.ObjectMeta{Namespace: fmt.Sprint(size), Name: "e"},
+			Message:    strings.Repeat("a", size),
+		}}
+		cwl.addEvent(context.Background(), evt)
+		stream := cwl.streams[fmt.Sprint(size)]
+		if got := len(aws.StringValue(stream.logEvents[0].Message)); got != maximumBytesPerEvent {
+			t.Errorf("Got a message of %d bytes for an event of %d, want %d", got, size, maximumBytesPerEvent)
+		}
+		if stream.currentByteLength != maximumBytesPerEvent+perEventBytes {
+			t.Errorf("Got %d bytes buffered, want %d", stream.currentByteLength, maximumBytesPerEvent+perEventBytes)
+		}
+	}
+}
+
+func TestRenderLogStreamName(t *testing.T) {
+	today := time.Now().UTC().Format("2006-01-02")
+	tests := []struct {
+		name     string
+		template string
+		cluster  *ClusterMetadata
+		want     string
+	}{
+		{name: "not a template", template: "events", want: "events"},
+		{name: "namespace", template: "{{.Namespace}}", want: "default"},
+		{name: "namespace and kind", template: "{{.Namespace}}/{{.InvolvedObject.Kind}}", want: "default/Pod"},
+		{name: "node", template: "{{.Source.Host}}", want: "node-1"},
+		{name: "day", template: "events-{{date}}", want: "events-" + today},
+		{name: "verb", template: "{{.Verb}}", want: "ADDED"},
+		{name: "cluster", template: "{{.Cluster.Name}}/{{.Namespace}}", cluster: &ClusterMetadata{Name: "prod"}, want: "prod/default"},
+		{name: "no cluster metadata", template: "{{.Cluster.Name}}/{{.Namespace}}", want: "/default"},
+		{name: "forbidden characters", template: "{{.Reason}}", want: "a_b_c"},
+		{name: "empty", template: "{{.Action}}", want: defaultLogStreamName},
+		{name: "render error", template: "{{.Namespace.Missing}}", want: defaultLogStreamName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logStreamTemplate, err := newLogStreamTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cwl := &CWLSink{logStreamName: tt.template, logStreamTemplate: logStreamTemplate}
+			evt := EventData{
+				Verb: "ADDED",
+				Event: &v1.Event{
+					ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e"},
+					InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "web"},
+					Source:         v1.EventSource{Host: "node-1"},
+					Reason:         "a:b*c",
+				},
+				Cluster: tt.cluster,
+			}
+			if got := cwl.renderLogStreamName(&evt); got != tt.want {
+				t.Errorf("Got log stream %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLogStreamTemplateInvalid(t *testing.T) {
+	if _, err := newLogStreamTemplate("{{.Namespace"); err == nil {
+		t.Error("Got no error for an invalid template")
+	}
+}
+
+func TestCWLSinkExpiresInactiveLogStreams(t *testing.T) {
+	client := &fakeLogsClient{uploaded: make(map[string]int)}
+	cwl := newTestCWLSink(t, client)
+	for _, ns := range []string{"active", "inactive"} {
+		cwl.addEvent(context.Background(), EventData{Verb: "ADDED", Event: &v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "e"}}})
+	}
+
+	// Streams are tracked while they have events to upload, and for an hour
+	// after their last upload
+	cwl.streams["inactive"].expiration = time.Now().Add(-time.Minute)
+	cwl.flushAll(context.Background())
+	if len(cwl.streams) != 2 {
+		t.Fatalf("Got %d log streams after uploading, want 2", len(cwl.streams))
+	}
+	cwl.streams["inactive"].expiration = time.Now().Add(-time.Minute)
+	cwl.flushAll(context.Background())
+	if _, ok := cwl.streams["inactive"]; ok || len(cwl.streams) != 1 {
+		t.Errorf("Got log streams %v, want only the active one", cwl.streams)
+	}
+	if client.uploaded["active"] != 1 || client.uploaded["inactive"] != 1 {
+		t.Errorf("Got uploads %v, want one event to each log stream", client.uploaded)
+	}
+}
@@ -0,0 +1,86 @@
+package sinks
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/metrics"
+)
+
+// The dead letter file of a sink is rotated once it grows beyond
+// deadLetterMaxSize, and deadLetterMaxBackups rotated files are kept
+const (
+	deadLetterMaxSize    = 100 * 1024 * 1024
+	deadLetterMaxBackups = 10
+)
+
+// deadLetter is the file a sink writes the events it failed to export to,
+// once its retries are exhausted. It holds one JSON event per line, so the
+// events can be replayed later.
+type deadLetter struct {
+	sink string
+	file *rotatingFile
+}
+
+// newDeadLetter opens the dead letter file of the named sink in dir
+func newDeadLetter(dir string, sink string) (*deadLetter, error) {
+	file, err := newRotatingFile(filepath.Join(dir, sink+".jsonl"), deadLetterMaxSize, 0, deadLetterMaxBackups, false)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter{sink: sink, file: file}, nil
+}
+
+// write appends the serialized events to the file and syncs it. It returns
+// false if they could not be written, or d is nil.
+func (d *deadLetter) write(lines []string) bool {
+	if d == nil {
+		return false
+	}
+
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	_, err := d.file.Write([]byte(buf.String()))
+	if err == nil {
+		err = d.file.Sync()
+	}
+	if err != nil {
+		log.Warningf("Failed to write %d events of sink %s to dead letter file %s: %v", len(lines), d.sink, d.file.path, err)
+		return false
+	}
+	metrics.EventsDeadLettered.WithLabelValues(d.sink).Add(float64(len(lines)))
+	log.Warningf("Wrote %d events of sink %s to dead letter file %s", len(lines), d.sink, d.file.path)
+	return true
+}
+
+// writeEvents serializes the events and appends them to the file, see write.
+// The payload options are not applied, so replay can read the events back.
+func (d *deadLetter) writeEvents(events []EventData) bool {
+	if d == nil {
+		return false
+	}
+
+	lines := make([]string, 0, len(events))
+	for i := range events {
+		eJSONBytes, err := json.Marshal(&events[i])
+		if err != nil {
+			log.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		lines = append(lines, string(eJSONBytes))
+	}
+	return d.write(lines)
+}
+
+// close closes the file, if any
+func (d *deadLetter) close() {
+	if d != nil {
+		d.file.Close()
+	}
+}
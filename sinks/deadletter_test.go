@@ -0,0 +1,43 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeadLetterIgnoresPayloadOptions(t *testing.T) {
+	setPayloadOptions(t, PayloadOptions{Include: []string{"verb"}, OldEvent: OldEventDiff, Compact: true})
+	dir := t.TempDir()
+	d, err := newDeadLetter(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []EventData{newTestUpdate(), NewEventData(newTestUpdate().Event, nil)}
+	if !d.writeEvents(events) {
+		t.Fatal("Failed to write the dead letters")
+	}
+	d.close()
+
+	// Replay must get back the events as they were
+	f, err := os.Open(filepath.Join(dir, "test.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []EventData
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var eData EventData
+		if err := json.Unmarshal(scanner.Bytes(), &eData); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, eData)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("Got dead letters %+v, want %+v", got, events)
+	}
+}
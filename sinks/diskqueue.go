@@ -0,0 +1,619 @@
+package sinks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/metrics"
+)
+
+const (
+	// diskQueueSegmentSize is the size after which a new segment file is
+	// started, it is lowered to half of the queue size for small queues
+	diskQueueSegmentSize = 8 * 1024 * 1024
+	// diskQueueRecordHeaderSize is the size of the length and the checksum
+	// in front of every record
+	diskQueueRecordHeaderSize = 8
+	// diskQueueMaxRecordSize protects against reading a corrupted length
+	diskQueueMaxRecordSize = 16 * 1024 * 1024
+	// diskQueueAckInterval is how often the acknowledged position is saved
+	diskQueueAckInterval = time.Second
+	// diskQueueSyncInterval is how often the appended records are flushed
+	// to disk
+	diskQueueSyncInterval = 200 * time.Millisecond
+
+	diskQueueSegmentExt = ".seg"
+	diskQueueAckFile    = "ack"
+)
+
+/*
+diskQueue is a write-ahead queue of events on a local volume. Events are
+appended to segment files as records of
+
+	[length uint32][crc32 uint32][JSON encoded EventData]
+
+and handed out in order through out. Records stay on disk until the sink
+acknowledges them, so they survive sink outages and process restarts. Once
+the segments grow beyond maxSize the oldest one is dropped, together with
+the events in it.
+
+Appended records are synced to disk every diskQueueSyncInterval, so a crash
+of the node loses the events put during the last interval. The acknowledged
+position is saved at most every diskQueueAckInterval, so after a crash the
+events acknowledged last may be delivered again.
+*/
+type diskQueue struct {
+	dir         string
+	sink        string
+	maxSize     int64
+	segmentSize int64
+
+	mu sync.Mutex
+	// segments are ordered by seq, the last one is appended to
+	segments []*diskQueueSegment
+	size     int64
+	writer   *os.File
+	// unsynced tells that records were appended to writer since the last sync
+	unsynced bool
+	// reader is the segment file records are read from
+	reader    *os.File
+	readerSeq uint64
+
+	// consumed is the position after the last record received by the sink,
+	// acked the position after the last record the sink has acknowledged
+	consumed diskQueuePosition
+	acked    diskQueuePosition
+	ackSaved time.Time
+
+	// gen changes whenever consumed moves back or skips records, records
+	// read for an older gen are not delivered
+	gen uint64
+
+	// out hands the records to the sink, wake signals new records and reset
+	// a change of gen
+	out   chan interface{}
+	wake  chan struct{}
+	reset chan struct{}
+	done  chan struct{}
+}
+
+type diskQueueSegment struct {
+	seq   uint64
+	size  int64
+	count int
+}
+
+// diskQueuePosition is the position of a record, index is its number within
+// the segment
+type diskQueuePosition struct {
+	Seq    uint64 `json:"seq"`
+	Offset int64  `json:"offset"`
+	Index  int    `json:"index"`
+}
+
+// diskQueueRecord is what the queue sends through out
+type diskQueueRecord struct {
+	eData EventData
+	gen   uint64
+	next  diskQueuePosition
+}
+
+// newDiskQueue opens the queue in dir, creating it if needed, and starts
+// handing out the records that have not been acknowledged yet
+func newDiskQueue(dir string, sink string, maxSize int64) (*diskQueue, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("disk queue size must be positive, got %d", maxSize)
+	}
+	q := &diskQueue{
+		dir:         dir,
+		sink:        sink,
+		maxSize:     maxSize,
+		segmentSize: diskQueueSegmentSize,
+		out:         make(chan interface{}),
+		wake:        make(chan struct{}, 1),
+		reset:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if q.segmentSize > maxSize/2 {
+		q.segmentSize = maxSize / 2
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		return nil, fmt.Errorf("failed to load disk queue %s: %v", dir, err)
+	}
+	log.Infof("Loaded disk queue %s with %d pending events", dir, q.Len())
+
+	go q.run()
+	go q.syncLoop()
+	return q, nil
+}
+
+// load reads the segments and the acknowledged position, removing the
+// segments that were fully acknowledged and truncating corrupted ones
+func (q *diskQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), diskQueueSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), diskQueueSegmentExt), 10, 64)
+		if err != nil {
+			log.Warningf("Ignoring unexpected file %s in disk queue %s", f.Name(), q.dir)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	if data, err := ioutil.ReadFile(filepath.Join(q.dir, diskQueueAckFile)); err == nil {
+		if err := json.Unmarshal(data, &q.acked); err != nil {
+			log.Warningf("Ignoring corrupted acknowledged position of disk queue %s: %v", q.dir, err)
+			q.acked = diskQueuePosition{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, seq := range seqs {
+		if seq < q.acked.Seq {
+			if err := os.Remove(q.segmentPath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		seg, err := q.scanSegment(seq)
+		if err != nil {
+			return err
+		}
+		q.segments = append(q.segments, seg)
+		q.size += seg.size
+	}
+
+	if seg := q.firstSegment(q.acked.Seq); seg == nil || seg.seq != q.acked.Seq || q.acked.Index > seg.count {
+		q.acked = diskQueuePosition{Seq: q.acked.Seq}
+	}
+	q.consumed = q.acked
+	return nil
+}
+
+// scanSegment counts the records of a segment, truncating it at the first
+// record that is incomplete or fails its checksum
+func (q *diskQueue) scanSegment(seq uint64) (*diskQueueSegment, error) {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &diskQueueSegment{seq: seq}
+	for {
+		_, n, err := readDiskQueueRecord(f, seg.size)
+		if err == io.EOF {
+			return seg, nil
+		}
+		if err != nil {
+			log.Warningf("Truncating disk queue segment %s at offset %d: %v", f.Name(), seg.size, err)
+			return seg, f.Truncate(seg.size)
+		}
+		seg.size += n
+		seg.count++
+	}
+}
+
+// put appends the event to the queue
+func (q *diskQueue) put(eData EventData) error {
+	payload, err := json.Marshal(eData)
+	if err != nil {
+		return fmt.Errorf("failed to json serialize event: %v", err)
+	}
+	record := make([]byte, diskQueueRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[diskQueueRecordHeaderSize:], payload)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	last := q.lastSegment()
+	if q.writer == nil || last.size >= q.segmentSize {
+		if last, err = q.newSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := q.writer.Write(record); err != nil {
+		// Do not append to a segment that may end in a partial record
+		q.writer.Close()
+		q.writer = nil
+		return err
+	}
+	last.size += int64(len(record))
+	last.count++
+	q.size += int64(len(record))
+	q.unsynced = true
+
+	for q.size > q.maxSize && len(q.segments) > 1 {
+		if err := q.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	notify(q.wake)
+	return nil
+}
+
+// newSegment starts a new segment file to append to
+func (q *diskQueue) newSegment() (*diskQueueSegment, error) {
+	seq := q.acked.Seq
+	if last := q.lastSegment(); last != nil {
+		seq = last.seq + 1
+	}
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if q.writer != nil {
+		q.sync()
+		q.writer.Close()
+	}
+	q.writer = f
+	seg := &diskQueueSegment{seq: seq}
+	q.segments = append(q.segments, seg)
+	return seg, nil
+}
+
+// dropOldest removes the oldest segment with all its events
+func (q *diskQueue) dropOldest() error {
+	seg, next := q.segments[0], q.segments[1]
+
+	var dropped int
+	switch {
+	case q.consumed.Seq == seg.seq:
+		dropped = seg.count - q.consumed.Index
+		q.consumed = diskQueuePosition{Seq: next.seq}
+		q.gen++
+		notify(q.reset)
+	case q.consumed.Seq < seg.seq:
+		dropped = seg.count
+	}
+	if q.acked.Seq <= seg.seq {
+		q.acked = diskQueuePosition{Seq: next.seq}
+	}
+	if q.reader != nil && q.readerSeq == seg.seq {
+		q.reader.Close()
+		q.reader = nil
+	}
+
+	if err := os.Remove(q.segmentPath(seg.seq)); err != nil {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.size -= seg.size
+	metrics.EventsDropped.WithLabelValues(q.sink).Add(float64(dropped))
+	log.Warningf("Disk queue %s is full, dropped its oldest segment with %d pending events", q.dir, dropped)
+	return nil
+}
+
+// run sends the records through out until the queue is closed
+func (q *diskQueue) run() {
+	var gen uint64
+	var pos diskQueuePosition
+	for {
+		q.mu.Lock()
+		if gen != q.gen || pos.Seq < q.consumed.Seq || (pos.Seq == q.consumed.Seq && pos.Index < q.consumed.Index) {
+			gen, pos = q.gen, q.consumed
+		}
+		rec, ok := q.read(&pos)
+		q.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-q.wake:
+			case <-q.reset:
+			case <-q.done:
+				return
+			}
+			continue
+		}
+
+		rec.gen = gen
+		select {
+		case q.out <- rec:
+			pos = rec.next
+		case <-q.reset:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// syncLoop syncs the appended records every diskQueueSyncInterval until the
+// queue is closed
+func (q *diskQueue) syncLoop() {
+	ticker := time.NewTicker(diskQueueSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			q.sync()
+			q.mu.Unlock()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// sync flushes the records appended to writer to disk
+func (q *diskQueue) sync() {
+	if q.writer == nil || !q.unsynced {
+		return
+	}
+	q.unsynced = false
+	if err := q.writer.Sync(); err != nil {
+		log.Warningf("Failed to sync disk queue %s: %v", q.dir, err)
+	}
+}
+
+// read reads the record at pos, moving pos to the next segment first if it
+// is at the end of one. It returns false if there is no record to read.
+func (q *diskQueue) read(pos *diskQueuePosition) (*diskQueueRecord, bool) {
+	for {
+		seg := q.firstSegment(pos.Seq)
+		if seg == nil {
+			return nil, false
+		}
+		if seg.seq != pos.Seq {
+			*pos = diskQueuePosition{Seq: seg.seq}
+		}
+		if pos.Index >= seg.count {
+			if seg == q.lastSegment() {
+				return nil, false
+			}
+			*pos = diskQueuePosition{Seq: seg.seq + 1}
+			continue
+		}
+
+		if q.reader == nil || q.readerSeq != seg.seq {
+			if q.reader != nil {
+				q.reader.Close()
+				q.reader = nil
+			}
+			f, err := os.Open(q.segmentPath(seg.seq))
+			if err != nil {
+				log.Errorf("Failed to open disk queue segment: %v", err)
+				return nil, false
+			}
+			q.reader, q.readerSeq = f, seg.seq
+		}
+
+		payload, n, err := readDiskQueueRecord(q.reader, pos.Offset)
+		var eData EventData
+		if err == nil {
+			err = json.Unmarshal(payload, &eData)
+		}
+		if err != nil {
+			// Skip the rest of the segment, and stop appending to it
+			log.Warningf("Skipping %d events of corrupted disk queue segment %s: %v", seg.count-pos.Index, q.reader.Name(), err)
+			seg.count = pos.Index
+			if seg == q.lastSegment() && q.writer != nil {
+				q.writer.Close()
+				q.writer = nil
+			}
+			continue
+		}
+
+		return &diskQueueRecord{
+			eData: eData,
+			next:  diskQueuePosition{Seq: pos.Seq, Offset: pos.Offset + n, Index: pos.Index + 1},
+		}, true
+	}
+}
+
+// received returns the event data of a record received from out. It returns
+// false for records read before the queue was rewound.
+func (q *diskQueue) received(e interface{}) (EventData, bool) {
+	rec, ok := e.(*diskQueueRecord)
+	if !ok {
+		log.Warningf("Invalid type sent through disk queue: %T", e)
+		return EventData{}, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if rec.gen != q.gen {
+		return EventData{}, false
+	}
+	q.consumed = rec.next
+	return rec.eData, true
+}
+
+// take reads up to max records that have not been received yet, as if they
+// were received from out
+func (q *diskQueue) take(max int) []EventData {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var events []EventData
+	pos := q.consumed
+	for len(events) < max {
+		rec, ok := q.read(&pos)
+		if !ok {
+			break
+		}
+		events = append(events, rec.eData)
+		pos = rec.next
+	}
+	if len(events) > 0 {
+		// The record run is about to send has been taken
+		q.consumed = pos
+		q.gen++
+		notify(q.reset)
+	}
+	return events
+}
+
+// Len returns the number of records not received yet
+func (q *diskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n int
+	for _, seg := range q.segments {
+		switch {
+		case seg.seq == q.consumed.Seq:
+			n += seg.count - q.consumed.Index
+		case seg.seq > q.consumed.Seq:
+			n += seg.count
+		}
+	}
+	return n
+}
+
+// ack acknowledges every record received so far, removing the segments that
+// are no longer needed
+func (q *diskQueue) ack() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.acked == q.consumed {
+		return
+	}
+	q.acked = q.consumed
+
+	for len(q.segments) > 1 && q.segments[0].seq < q.acked.Seq {
+		seg := q.segments[0]
+		if q.reader != nil && q.readerSeq == seg.seq {
+			q.reader.Close()
+			q.reader = nil
+		}
+		if err := os.Remove(q.segmentPath(seg.seq)); err != nil {
+			log.Warningf("Failed to remove disk queue segment: %v", err)
+			break
+		}
+		q.segments = q.segments[1:]
+		q.size -= seg.size
+	}
+
+	if time.Since(q.ackSaved) >= diskQueueAckInterval {
+		q.saveAck()
+	}
+}
+
+// rewind delivers every record received since the last ack again
+func (q *diskQueue) rewind() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.consumed == q.acked {
+		return
+	}
+	q.consumed = q.acked
+	q.gen++
+	notify(q.reset)
+}
+
+// close stops handing out records and saves the acknowledged position
+func (q *diskQueue) close() {
+	close(q.done)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.saveAck()
+	if q.writer != nil {
+		q.sync()
+		q.writer.Close()
+		q.writer = nil
+	}
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+}
+
+// saveAck writes the acknowledged position, through a temporary file so a
+// crash never leaves a partial one
+func (q *diskQueue) saveAck() {
+	q.ackSaved = time.Now()
+	data, err := json.Marshal(q.acked)
+	if err == nil {
+		path := filepath.Join(q.dir, diskQueueAckFile)
+		if err = ioutil.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Warningf("Failed to save acknowledged position of disk queue %s: %v", q.dir, err)
+	}
+}
+
+func (q *diskQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, diskQueueSegmentExt))
+}
+
+// firstSegment returns the first segment with a seq of at least seq
+func (q *diskQueue) firstSegment(seq uint64) *diskQueueSegment {
+	for _, seg := range q.segments {
+		if seg.seq >= seq {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (q *diskQueue) lastSegment() *diskQueueSegment {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	return q.segments[len(q.segments)-1]
+}
+
+// notify notifies the run loop without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// readDiskQueueRecord reads the payload of the record at offset, and returns
+// it with the size of the whole record. It returns io.EOF if there is no
+// record at offset.
+func readDiskQueueRecord(r io.ReaderAt, offset int64) ([]byte, int64, error) {
+	header := make([]byte, diskQueueRecordHeaderSize)
+	n, err := r.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < len(header) {
+		return nil, 0, fmt.Errorf("incomplete record header: %v", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > diskQueueMaxRecordSize {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+	payload := make([]byte, length)
+	if n, err = r.ReadAt(payload, offset+diskQueueRecordHeaderSize); n < len(payload) {
+		return nil, 0, fmt.Errorf("incomplete record: %v", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+	return payload, int64(diskQueueRecordHeaderSize + len(payload)), nil
+}
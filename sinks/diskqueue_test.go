@@ -0,0 +1,301 @@
+package sinks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putEvents queues an event per name
+func putEvents(t *testing.T, q *diskQueue, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := q.put(newTestEventData(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receiveEvents returns the names of the events delivered by the queue until
+// none is delivered for a while
+func receiveEvents(q *diskQueue) []string {
+	var names []string
+	for {
+		select {
+		case e := <-q.out:
+			if evt, ok := q.received(e); ok {
+				names = append(names, evt.Event.Name)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return names
+		}
+	}
+}
+
+// receiveN returns the names of the next n events delivered by the queue
+func receiveN(t *testing.T, q *diskQueue, n int) []string {
+	t.Helper()
+	var names []string
+	for len(names) < n {
+		select {
+		case e := <-q.out:
+			if evt, ok := q.received(e); ok {
+				names = append(names, evt.Event.Name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event %d of %d", len(names)+1, n)
+		}
+	}
+	return names
+}
+
+func eventNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("e%d", i)
+	}
+	return names
+}
+
+// segmentFiles returns the number of segment files in dir
+func segmentFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskQueueSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// newTestDiskQueue opens a queue in dir whose segments hold about
+// eventsPerSegment events
+func newTestDiskQueue(t *testing.T, dir string, eventsPerSegment int) *diskQueue {
+	t.Helper()
+	q, err := newDiskQueue(dir, "test", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventsPerSegment > 0 {
+		q.mu.Lock()
+		q.segmentSize = int64(eventsPerSegment) * testRecordSize(t)
+		q.mu.Unlock()
+	}
+	return q
+}
+
+// testRecordSize returns the size of the record of a test event
+func testRecordSize(t *testing.T) int64 {
+	t.Helper()
+	q, err := newDiskQueue(t.TempDir(), "test", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	putEvents(t, q, "e0")
+	return q.size
+}
+
+func TestDiskQueueRestart(t *testing.T) {
+	tests := []struct {
+		name             string
+		eventsPerSegment int
+		put              int
+		// received events are received before the restart, the first
+		// acked of them are acknowledged
+		received     int
+		acked        int
+		wantDelivery []string
+		wantSegments int
+	}{
+		{"delivers every event", 0, 3, 0, 0, []string{"e0", "e1", "e2"}, 1},
+		{"delivers unacknowledged events again", 0, 3, 2, 0, []string{"e0", "e1", "e2"}, 1},
+		{"skips acknowledged events", 0, 4, 3, 2, []string{"e2", "e3"}, 1},
+		{"skips every event", 0, 2, 2, 2, nil, 1},
+		{"spans segments", 2, 5, 0, 0, eventNames(5), 3},
+		{"removes acknowledged segments", 2, 7, 5, 5, []string{"e5", "e6"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			q := newTestDiskQueue(t, dir, tt.eventsPerSegment)
+			putEvents(t, q, eventNames(tt.put)...)
+			if tt.acked > 0 {
+				receiveN(t, q, tt.acked)
+				q.ack()
+			}
+			receiveN(t, q, tt.received-tt.acked)
+			q.close()
+
+			q = newTestDiskQueue(t, dir, tt.eventsPerSegment)
+			defer q.close()
+			if got := q.Len(); got != len(tt.wantDelivery) {
+				t.Errorf("Got %d pending events, want %d", got, len(tt.wantDelivery))
+			}
+			if got := receiveEvents(q); fmt.Sprint(got) != fmt.Sprint(tt.wantDelivery) {
+				t.Errorf("Got events %v after restart, want %v", got, tt.wantDelivery)
+			}
+			if got := segmentFiles(t, dir); got != tt.wantSegments {
+				t.Errorf("Got %d segment files, want %d", got, tt.wantSegments)
+			}
+		})
+	}
+}
+
+func TestDiskQueueRewind(t *testing.T) {
+	tests := []struct {
+		name string
+		// the first acked events are received and acknowledged, then
+		// received more before the rewind
+		acked        int
+		received     int
+		wantRedelive []string
+	}{
+		{"nothing received", 0, 0, nil},
+		{"nothing acknowledged", 0, 3, []string{"e0", "e1", "e2"}},
+		{"some acknowledged", 2, 1, []string{"e2"}},
+		{"everything acknowledged", 3, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestDiskQueue(t, t.TempDir(), 0)
+			defer q.close()
+			putEvents(t, q, "e0", "e1", "e2")
+			receiveN(t, q, tt.acked)
+			q.ack()
+			receiveN(t, q, tt.received)
+
+			q.rewind()
+			want := append(tt.wantRedelive, eventNames(3)[tt.acked+tt.received:]...)
+			if got := receiveEvents(q); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("Got events %v after rewind, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDiskQueueTake(t *testing.T) {
+	q := newTestDiskQueue(t, t.TempDir(), 2)
+	defer q.close()
+	putEvents(t, q, eventNames(5)...)
+
+	first := receiveN(t, q, 1)
+	var taken []string
+	for _, evt := range q.take(3) {
+		taken = append(taken, evt.Event.Name)
+	}
+	if want := []string{"e1", "e2", "e3"}; fmt.Sprint(taken) != fmt.Sprint(want) {
+		t.Errorf("Got events %v taken after %v, want %v", taken, first, want)
+	}
+	// The events taken are not delivered through out as well
+	if got := receiveEvents(q); fmt.Sprint(got) != "[e4]" {
+		t.Errorf("Got events %v after take, want [e4]", got)
+	}
+
+	q.rewind()
+	if got := receiveEvents(q); fmt.Sprint(got) != fmt.Sprint(eventNames(5)) {
+		t.Errorf("Got events %v after rewind, want %v", got, eventNames(5))
+	}
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	recordSize := testRecordSize(t)
+	tests := []struct {
+		name     string
+		received int
+		want     []string
+	}{
+		{"drops pending events", 0, []string{"e4", "e5", "e6", "e7", "e8", "e9"}},
+		{"drops received events", 3, []string{"e4", "e5", "e6", "e7", "e8", "e9"}},
+		{"keeps delivering after the dropped segment", 5, []string{"e5", "e6", "e7", "e8", "e9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Segments of 2 events, 6 events fit
+			q, err := newDiskQueue(t.TempDir(), "test", 6*recordSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.close()
+			q.segmentSize = 2 * recordSize
+			putEvents(t, q, eventNames(6)...)
+			receiveN(t, q, tt.received)
+			putEvents(t, q, "e6", "e7", "e8", "e9")
+
+			if q.size > q.maxSize {
+				t.Errorf("Got a queue of %d bytes, want at most %d", q.size, q.maxSize)
+			}
+			if got := receiveEvents(q); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Got events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskQueueCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    []string
+	}{
+		{"partial record", func(data []byte) []byte { return data[:len(data)-3] }, []string{"e0", "e1"}},
+		{"checksum mismatch", func(data []byte) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}, []string{"e0", "e1"}},
+		{"garbage appended", func(data []byte) []byte {
+			return append(data, []byte(strings.Repeat("x", 20))...)
+		}, []string{"e0", "e1", "e2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			q := newTestDiskQueue(t, dir, 0)
+			putEvents(t, q, "e0", "e1", "e2")
+			q.close()
+
+			path := q.segmentPath(q.segments[0].seq)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, tt.corrupt(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			q = newTestDiskQueue(t, dir, 0)
+			defer q.close()
+			if got := receiveEvents(q); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Got events %v, want %v", got, tt.want)
+			}
+			// New events are appended after the last valid record
+			putEvents(t, q, "new")
+			if got := receiveEvents(q); fmt.Sprint(got) != "[new]" {
+				t.Errorf("Got events %v, want [new]", got)
+			}
+		})
+	}
+}
+
+func TestDiskQueueSync(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestDiskQueue(t, dir, 0)
+	defer q.close()
+	putEvents(t, q, "e0")
+
+	waitFor(t, "the sync", func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return !q.unsynced
+	})
+	info, err := os.Stat(q.segmentPath(q.segments[0].seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != q.size {
+		t.Errorf("Got a segment of %d bytes, want %d", info.Size(), q.size)
+	}
+}
@@ -0,0 +1,190 @@
+package sinks
+
+import (
+	"github.com/eapache/channels"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/metrics"
+)
+
+// eventChannel is the buffer between the eventRouter and a sink. It keeps
+// the events in memory, where with discarding enabled it never blocks and
+// the events it discards because it is full are counted for the sink, or in
+// a diskQueue once persist has been called.
+//
+// Events received from Out must be passed through event. With a diskQueue
+// they are only removed from disk once the sink calls ack after exporting
+// them, and rewind delivers every event received since the last ack again.
+type eventChannel struct {
+	sink     string
+	overflow bool
+
+	mem  channels.Channel
+	disk *diskQueue
+}
+
+// newEventChannel creates the buffer of the named sink. buffer tells several
+// buffers of the same sink apart in the metrics.
+func newEventChannel(sink string, buffer string, overflow bool, bufferSize int) *eventChannel {
+	c := &eventChannel{
+		sink:     sink,
+		overflow: overflow,
+	}
+	if overflow {
+		c.mem = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		c.mem = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+	metrics.RegisterBufferLength(sink, buffer, c.Len)
+	return c
+}
+
+// persist moves the buffer to a diskQueue in dir. It must be called before
+// any event is sent.
+func (c *eventChannel) persist(dir string, maxSize int64) error {
+	q, err := newDiskQueue(dir, c.sink, maxSize)
+	if err != nil {
+		return err
+	}
+	c.disk = q
+	return nil
+}
+
+// send writes the event data to the buffer
+func (c *eventChannel) send(eData EventData) {
+	if c.disk != nil {
+		if err := c.disk.put(eData); err != nil {
+			metrics.EventsDropped.WithLabelValues(c.sink).Inc()
+			log.Warningf("Failed to queue event for sink %s: %v", c.sink, err)
+		}
+		return
+	}
+	// The OverflowingChannel silently discards the event once it is full
+	if c.overflow && c.mem.Len() >= int(c.mem.Cap()) {
+		metrics.EventsDropped.WithLabelValues(c.sink).Inc()
+	}
+	c.mem.In() <- eData
+}
+
+// Out returns the channel the buffered events are received from
+func (c *eventChannel) Out() <-chan interface{} {
+	if c.disk != nil {
+		return c.disk.out
+	}
+	return c.mem.Out()
+}
+
+// event returns the event data of a value received from Out. It returns
+// false if the value must be skipped.
+func (c *eventChannel) event(e interface{}) (EventData, bool) {
+	if c.disk != nil {
+		return c.disk.received(e)
+	}
+	evt, ok := e.(EventData)
+	if !ok {
+		log.Warningf("Invalid type sent through event channel: %T", e)
+	}
+	return evt, ok
+}
+
+// Len returns the number of events waiting in the buffer
+func (c *eventChannel) Len() int {
+	if c.disk != nil {
+		return c.disk.Len()
+	}
+	return c.mem.Len()
+}
+
+// drain returns the events still in the memory buffer without waiting for
+// more, so a stopping sink can flush them. Events queued on disk are kept
+// there for the next start instead.
+func (c *eventChannel) drain() []EventData {
+	if c.disk != nil {
+		return nil
+	}
+	var events []EventData
+	for n := c.mem.Len(); n > 0; n-- {
+		if evt, ok := c.event(<-c.mem.Out()); ok {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+// take returns up to max events that are already buffered, without waiting
+// for more
+func (c *eventChannel) take(max int) []EventData {
+	if c.disk != nil {
+		return c.disk.take(max)
+	}
+	var events []EventData
+	for n := c.mem.Len(); n > 0 && len(events) < max; n-- {
+		if evt, ok := c.event(<-c.mem.Out()); ok {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+// ack marks every event received so far as exported
+func (c *eventChannel) ack() {
+	if c.disk != nil {
+		c.disk.ack()
+	}
+}
+
+// rewind delivers every event received since the last ack again, it returns
+// false if the buffer cannot do that and the events are lost
+func (c *eventChannel) rewind() bool {
+	if c.disk != nil {
+		c.disk.rewind()
+		return true
+	}
+	return false
+}
+
+// redeliver delivers the events received since the last ack again after
+// their export failed with err, if err may go away by itself and the buffer
+// can. Otherwise the failed events are given up on. It returns true if the
+// events are delivered again.
+func (c *eventChannel) redeliver(err error, failed int) bool {
+	if isRetryable(err) && c.rewind() {
+		return true
+	}
+	c.fail(failed)
+	return false
+}
+
+// fail counts the given number of events as lost and acknowledges every
+// event received so far, so they are not delivered again
+func (c *eventChannel) fail(failed int) {
+	metrics.EventsFailed.WithLabelValues(c.sink).Add(float64(failed))
+	c.ack()
+}
+
+// requeue appends the events whose export failed with err to the buffer
+// again and acknowledges every event received so far, if err may go away by
+// itself and the buffer is on disk. Unlike redeliver this does not deliver the
+// events that were exported again. Otherwise the failed events are given up
+// on. It returns true if the events are queued again.
+func (c *eventChannel) requeue(err error, failed []EventData) bool {
+	if c.disk == nil || !isRetryable(err) {
+		c.fail(len(failed))
+		return false
+	}
+	for _, eData := range failed {
+		if err := c.disk.put(eData); err != nil {
+			metrics.EventsFailed.WithLabelValues(c.sink).Inc()
+			log.Warningf("Failed to queue event for sink %s again: %v", c.sink, err)
+		}
+	}
+	c.ack()
+	return true
+}
+
+// close releases the diskQueue, if any
+func (c *eventChannel) close() {
+	if c.disk != nil {
+		c.disk.close()
+	}
+}
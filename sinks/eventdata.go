@@ -1,14 +1,15 @@
 package sinks
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/crewjam/rfc5424"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/json-iterator/go/extra"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/nytlabs/gojsonexplode"
 )
@@ -19,6 +20,49 @@ type EventData struct {
 	Verb     string    `json:"verb"`
 	Event    *v1.Event `json:"event"`
 	OldEvent *v1.Event `json:"old_event,omitempty"`
+	// Aggregation is set if several records of the event were coalesced
+	// into this one, Event is then the latest of them
+	Aggregation *Aggregation `json:"aggregation,omitempty"`
+	// InvolvedObject is the metadata of the object the event is about, if
+	// enrichment is enabled and the object was found
+	InvolvedObject *ObjectMetadata `json:"involved_object,omitempty"`
+	// Cluster identifies the cluster the event comes from, if configured
+	Cluster *ClusterMetadata `json:"cluster,omitempty"`
+}
+
+// ClusterMetadata identifies the cluster events are exported from
+type ClusterMetadata struct {
+	Name string `json:"name,omitempty"`
+	// ID is the UID of the kube-system namespace, if discovered
+	ID          string            `json:"id,omitempty"`
+	Region      string            `json:"region,omitempty"`
+	Account     string            `json:"account,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// ObjectMetadata is the metadata of the object an event is about
+type ObjectMetadata struct {
+	Labels          map[string]string       `json:"labels,omitempty"`
+	Annotations     map[string]string       `json:"annotations,omitempty"`
+	OwnerReferences []metav1.OwnerReference `json:"owner_references,omitempty"`
+	// Owner is the top-level controller of the object, e.g. the Deployment
+	// of a Pod, or nil if the object is not controlled by another one
+	Owner *metav1.OwnerReference `json:"owner,omitempty"`
+	// NodeName is the node a Pod is scheduled to
+	NodeName string `json:"node_name,omitempty"`
+}
+
+// Aggregation summarizes the records of an event coalesced within a window
+type Aggregation struct {
+	// Count is by how much the count of the event grew over the records
+	Count int32 `json:"count"`
+	// Records is the number of records coalesced
+	Records int `json:"records"`
+	// FirstTimestamp and LastTimestamp are when the first and the last of
+	// the records were observed, see EventTimestamp
+	FirstTimestamp metav1.Time `json:"first_timestamp"`
+	LastTimestamp  metav1.Time `json:"last_timestamp"`
 }
 
 // NewEventData constructs an EventData struct from an old and new event,
@@ -41,18 +85,54 @@ func NewEventData(eNew *v1.Event, eOld *v1.Event) EventData {
 	return eData
 }
 
+// EventTimestamp returns when the event was last observed. Events that do not
+// set LastTimestamp fall back to the series, the event time, the first
+// timestamp and finally the creation time.
+func EventTimestamp(e *v1.Event) time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case e.Series != nil && !e.Series.LastObservedTime.IsZero():
+		return e.Series.LastObservedTime.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	case !e.FirstTimestamp.IsZero():
+		return e.FirstTimestamp.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
 // WriteRFC5424 writes the current event data to the given io.Writer using
 // RFC5424 (syslog over TCP) syntax.
 func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
-	var eJSONBytes []byte
-	var err error
-	if eJSONBytes, err = json.Marshal(e); err != nil {
-		return 0, fmt.Errorf("failed to json serialize event: %v", err)
+	msg, err := e.rfc5424MessageWith(nil)
+	if err != nil {
+		return 0, err
 	}
 
 	// Each message should look like an RFC5424 syslog message:
 	// <NumberOfBytes/ASCII encoded integer><Space character><RFC5424 message:NumberOfBytes long>
-	//
+	return msg.WriteTo(w)
+}
+
+// MarshalRFC5424 returns the current event data as a single RFC5424 message
+// without the octet-counting prefix, as used by syslog over UDP.
+func (e *EventData) MarshalRFC5424() ([]byte, error) {
+	msg, err := e.rfc5424MessageWith(nil)
+	if err != nil {
+		return nil, err
+	}
+	return msg.MarshalBinary()
+}
+
+// rfc5424MessageWith builds the RFC5424 message of the event data, with the
+// message rendered by the template
+func (e *EventData) rfc5424MessageWith(template *messageTemplate) (rfc5424.Message, error) {
+	eJSONBytes, err := template.format(e)
+	if err != nil {
+		return rfc5424.Message{}, fmt.Errorf("failed to format event: %v", err)
+	}
+
 	// Note: There are some restrictions on length and character space for
 	// Hostname and AppName, see
 	// https://github.com/crewjam/rfc5424/blob/master/marshal.go#L90. There's no
@@ -60,13 +140,13 @@ func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
 	// names already adhere to this convention in practice.
 	msg := rfc5424.Message{
 		Priority:  rfc5424.Daemon,
-		Timestamp: e.Event.LastTimestamp.Time,
+		Timestamp: EventTimestamp(e.Event),
 		Hostname:  e.Event.Source.Host,
 		AppName:   e.Event.Source.Component,
 		Message:   eJSONBytes,
 	}
 
-	return msg.WriteTo(w)
+	return msg, nil
 }
 
 // WriteFlattenedJSON writes the json to the file in the below format
@@ -76,8 +156,13 @@ func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
 func (e *EventData) WriteFlattenedJSON(w io.Writer) (int64, error) {
 	var eJSONBytes []byte
 	var err error
-	extra.SetNamingStrategy(extra.LowerCaseWithUnderscores)
-	if eJSONBytes, err = jsoniter.Marshal(e); err != nil {
+	if sinkPayload.isZero() {
+		extra.SetNamingStrategy(extra.LowerCaseWithUnderscores)
+		eJSONBytes, err = jsoniter.Marshal(e)
+	} else {
+		eJSONBytes, err = marshalEventData(e)
+	}
+	if err != nil {
 		return 0, fmt.Errorf("failed to json serialize event: %v", err)
 	}
 
@@ -0,0 +1,172 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
+)
+
+/*
+FileSink is the sink that writes the kubernetes events to a local file, one
+event per line, so that node-local log shippers can pick them up. Lines are
+either plain JSON or flattened JSON (see EventData.WriteFlattenedJSON).
+The file is rotated by size and age and synced to disk every syncInterval.
+*/
+type FileSink struct {
+	file *rotatingFile
+
+	// flatten selects EventData.WriteFlattenedJSON over plain JSON
+	flatten bool
+
+	// template renders the lines instead of the format if set
+	template *messageTemplate
+
+	// syncInterval tells how often the file is synced to disk
+	syncInterval time.Duration
+
+	// eventCh is used to interact eventRouter and the sharedInformer
+	eventCh *eventChannel
+	// failed is set when a write has failed since the last sync
+	failed bool
+
+	heartbeat *health.Heartbeat
+
+	// lineBuf holds a serialized event so it is written in a single call
+	lineBuf *bytes.Buffer
+}
+
+// NewFileSink is the factory method constructing a new FileSink. format is
+// either json or flattened.
+func NewFileSink(file *rotatingFile, format string, syncInterval time.Duration, overflow bool, bufferSize int) (*FileSink, error) {
+	var flatten bool
+	switch format {
+	case "json":
+	case "flattened":
+		flatten = true
+	default:
+		return nil, fmt.Errorf("unsupported file format %q, must be one of json or flattened", format)
+	}
+	if syncInterval <= 0 {
+		return nil, fmt.Errorf("file sync interval must be positive, got %v", syncInterval)
+	}
+
+	fs := &FileSink{
+		file:         file,
+		flatten:      flatten,
+		syncInterval: syncInterval,
+		lineBuf:      bytes.NewBuffer(make([]byte, 0, 4096)),
+		eventCh:      newEventChannel(logFileSinkName, "sink", overflow, bufferSize),
+		heartbeat:    newSinkHeartbeat(logFileSinkName),
+	}
+
+	return fs, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this FileSink
+// are discarded.
+func (fs *FileSink) UpdateEvents(eData EventData) {
+	fs.eventCh.send(eData)
+}
+
+// Run sits in a loop, waiting for data to come in through fs.eventCh and
+// appending them to the file. Every syncInterval the file is synced to disk
+// and rotated if it has grown too old. When ctx is done the remaining events
+// are written and the file is synced before Run returns.
+func (fs *FileSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(fs.syncInterval)
+	defer ticker.Stop()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+	defer fs.file.Close()
+
+	for {
+		select {
+		case e := <-fs.eventCh.Out():
+			evt, ok := fs.eventCh.event(e)
+			if !ok {
+				continue
+			}
+			fs.export(&evt)
+		case <-ticker.C:
+			fs.sync()
+			if err := fs.file.rotateIfExpired(); err != nil {
+				log.Warningf("Failed to rotate %s: %v", fs.file.path, err)
+			}
+		case <-heartbeatTicker.C:
+			fs.heartbeat.Beat()
+		case <-ctx.Done():
+			for _, evt := range fs.eventCh.drain() {
+				fs.export(&evt)
+			}
+			fs.sync()
+			fs.eventCh.close()
+			return
+		}
+	}
+}
+
+// sync syncs the file to disk. The events written since the last sync are
+// then acknowledged, or delivered again by a disk backed eventCh if a write
+// or the sync failed. All of them are written again then, including those
+// whose write succeeded: delivery is at least once.
+func (fs *FileSink) sync() {
+	err := fs.file.Sync()
+	if err != nil {
+		log.Warningf("Failed to sync %s: %v", fs.file.path, err)
+	}
+	if err != nil || fs.failed {
+		fs.eventCh.rewind()
+		fs.failed = false
+		return
+	}
+	fs.eventCh.ack()
+}
+
+// export writes the event as one line to the file, counting the outcome
+func (fs *FileSink) export(evt *EventData) {
+	if err := fs.format(evt); err != nil {
+		// The event can never be serialized, there is no point in retrying
+		metrics.ExportFailures.WithLabelValues(logFileSinkName, "format").Inc()
+		log.Warningf("Failed to format event, skipping it: %v", err)
+		return
+	}
+	if _, err := fs.file.Write(fs.lineBuf.Bytes()); err != nil {
+		metrics.ExportFailures.WithLabelValues(logFileSinkName, "write").Inc()
+		log.Warningf("Failed to write event to %s: %v", fs.file.path, err)
+		fs.failed = true
+		return
+	}
+	metrics.EventsExported.WithLabelValues(logFileSinkName).Inc()
+}
+
+// format serializes a single event as one line into fs.lineBuf
+func (fs *FileSink) format(evt *EventData) error {
+	fs.lineBuf.Reset()
+	if fs.template != nil {
+		line, err := fs.template.format(evt)
+		if err != nil {
+			return fmt.Errorf("failed to format event: %v", err)
+		}
+		fs.lineBuf.Write(bytes.TrimSuffix(line, []byte("\n")))
+	} else if fs.flatten {
+		if _, err := evt.WriteFlattenedJSON(fs.lineBuf); err != nil {
+			return err
+		}
+	} else {
+		eJSONBytes, err := marshalEventData(evt)
+		if err != nil {
+			return fmt.Errorf("failed to json serialize event: %v", err)
+		}
+		fs.lineBuf.Write(eJSONBytes)
+	}
+	fs.lineBuf.WriteByte('\n')
+	return nil
+}
@@ -0,0 +1,288 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sethgrid/pester"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
+)
+
+/*
+HTTPSink is the sink that POSTs the kubernetes events as a JSON array to a
+webhook URL. Events that arrive between loop iterations are sent together,
+split into requests of at most batchSize events each. Requests failing with
+a 5xx or 429 status or a network error are retried according to the retry
+policy, after which the batch is written to the dead letter file if there is
+one.
+*/
+type HTTPSink struct {
+	// client is the http client, retries are left to the retry policy
+	client  *pester.Client
+	url     string
+	headers http.Header
+
+	// batchSize is the maximum number of events sent in a single request
+	batchSize int
+
+	// retry decides how failed requests are retried, deadLetter keeps the
+	// events of the requests that failed for good
+	retry      *RetryPolicy
+	deadLetter *deadLetter
+
+	// template renders each event of a request, which are then sent one per
+	// line instead of as a JSON array. It is nil for JSON.
+	template *messageTemplate
+
+	// eventCh is used to interact eventRouter and the sharedInformer
+	eventCh *eventChannel
+
+	heartbeat *health.Heartbeat
+
+	// bodyBuf stores the serialized batch before upload
+	bodyBuf *bytes.Buffer
+}
+
+// NewHTTPSink is the factory method constructing a new HTTPSink
+func NewHTTPSink(url string, headers http.Header, batchSize int, timeout time.Duration, retry *RetryPolicy, overflow bool, bufferSize int) (*HTTPSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("http sink url must not be empty")
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("http sink batch size must be positive, got %d", batchSize)
+	}
+
+	client := pester.New()
+	client.MaxRetries = 1
+	client.Timeout = timeout
+
+	h := &HTTPSink{
+		client:    client,
+		url:       url,
+		headers:   headers,
+		batchSize: batchSize,
+		retry:     retry,
+		bodyBuf:   bytes.NewBuffer(make([]byte, 0, 4096)),
+		eventCh:   newEventChannel(httpSinkName, "sink", overflow, bufferSize),
+		heartbeat: newSinkHeartbeat(httpSinkName),
+	}
+
+	return h, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this HTTPSink
+// are discarded.
+func (h *HTTPSink) UpdateEvents(eData EventData) {
+	h.eventCh.send(eData)
+}
+
+// Run sits in a loop, waiting for data to come in through h.eventCh,
+// and forwarding them to the HTTP endpoint. If multiple events have happened
+// between loop iterations, it puts them in as few requests as the batch size
+// allows instead of making a single request per event. When ctx is done the
+// remaining events are sent before Run returns.
+//
+// If a disk backed eventCh is used, events of requests that failed with a
+// retryable error and could not be dead lettered are sent again after a
+// backoff. Other failed events are given up on. Since every event since the
+// last ack is sent again, the batches that succeeded alongside a failed one
+// are sent twice: delivery is at least once.
+func (h *HTTPSink) Run(ctx context.Context) {
+	defer h.eventCh.close()
+	defer h.deadLetter.close()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	backoff := newSinkBackoff()
+	for {
+		select {
+		case e := <-h.eventCh.Out():
+			evt, ok := h.eventCh.event(e)
+			if !ok {
+				continue
+			}
+
+			// Start with just this event, and consume the buffered events into
+			// the same batch, in case more have been written since we last
+			// forwarded them
+			failed, err := h.drainEvents(ctx, append([]EventData{evt}, h.eventCh.take(h.batchSize-1)...))
+			if err == nil {
+				h.eventCh.ack()
+				backoff = newSinkBackoff()
+				continue
+			}
+			if h.eventCh.redeliver(err, failed) {
+				select {
+				case <-time.After(backoff.Step()):
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-heartbeatTicker.C:
+			h.heartbeat.Beat()
+		case <-ctx.Done():
+			if failed, err := h.drainEvents(ctx, h.eventCh.drain()); err != nil {
+				h.eventCh.redeliver(err, failed)
+			} else {
+				h.eventCh.ack()
+			}
+			return
+		}
+	}
+}
+
+// drainEvents takes an array of event data and sends it to the endpoint in
+// batches of at most h.batchSize events. Batches that fail for good are dead
+// lettered, it returns the number of events that could not be and the error
+// of the last of their batches.
+func (h *HTTPSink) drainEvents(ctx context.Context, events []EventData) (failed int, err error) {
+	for start := 0; start < len(events); start += h.batchSize {
+		// Every upload may take a while with retries, but it is progress
+		h.heartbeat.Beat()
+		end := start + h.batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		batch := events[start:end]
+		metrics.BatchSize.WithLabelValues(httpSinkName).Observe(float64(len(batch)))
+		uploadErr := h.retry.Do(ctx, httpSinkName, func() error {
+			return h.upload(batch)
+		})
+		if uploadErr != nil {
+			log.Warningf("Failed to send %d events to %s: %v", len(batch), h.url, uploadErr)
+			if !h.deadLetter.writeEvents(batch) {
+				failed += len(batch)
+				err = uploadErr
+			}
+			continue
+		}
+		metrics.EventsExported.WithLabelValues(httpSinkName).Add(float64(len(batch)))
+	}
+	return failed, err
+}
+
+// upload serializes a batch of events as a JSON array, or one rendered
+// template per line, and POSTs it
+func (h *HTTPSink) upload(events []EventData) error {
+	// Reuse the body buffer for each request
+	h.bodyBuf.Reset()
+	h.writeBody(events)
+
+	req, err := http.NewRequest(http.MethodPost, h.url, h.bodyBuf)
+	if err != nil {
+		return err
+	}
+	for name, values := range h.headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if req.Header.Get("Content-Type") == "" {
+		// Rendered templates are lines of text, which may or may not be JSON
+		if h.template != nil {
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		metrics.ExportFailures.WithLabelValues(httpSinkName, "error").Inc()
+		return err
+	}
+	// Drain the body so the underlying connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		metrics.ExportFailures.WithLabelValues(httpSinkName, strconv.Itoa(resp.StatusCode)).Inc()
+		return &httpStatusError{status: resp.Status, statusCode: resp.StatusCode}
+	}
+	log.V(3).Infof("Sent %d events to %s", len(events), h.url)
+	return nil
+}
+
+// writeBody serializes the batch of events into h.bodyBuf. Events that
+// cannot be serialized are skipped, there is no point in retrying them.
+func (h *HTTPSink) writeBody(events []EventData) {
+	if h.template == nil {
+		h.bodyBuf.WriteByte('[')
+	}
+	written := 0
+	for i := range events {
+		message, err := h.template.format(&events[i])
+		if err != nil {
+			metrics.ExportFailures.WithLabelValues(httpSinkName, "format").Inc()
+			log.Warningf("Failed to format event, skipping it: %v", err)
+			continue
+		}
+		if h.template != nil {
+			h.bodyBuf.Write(bytes.TrimSuffix(message, []byte("\n")))
+			h.bodyBuf.WriteByte('\n')
+			continue
+		}
+		if written > 0 {
+			h.bodyBuf.WriteByte(',')
+		}
+		h.bodyBuf.Write(message)
+		written++
+	}
+	if h.template == nil {
+		h.bodyBuf.WriteString("]\n")
+	}
+}
+
+// Check implements the Checker interface. It makes sure a connection can be
+// opened to the endpoint, without sending a request.
+func (h *HTTPSink) Check() error {
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, h.client.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// parseHeaders parses a comma separated list of Name=value pairs into an
+// http.Header
+func parseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name=value", pair)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
@@ -0,0 +1,284 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/sethgrid/pester"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// webhook is an httptest.Server recording the names of the events it
+// receives, answering with the given statuses in turn and 200 afterwards
+type webhook struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	batches  [][]string
+}
+
+func newWebhook(t *testing.T, statuses ...int) *webhook {
+	w := &webhook{statuses: statuses}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var events []EventData
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("Invalid request body: %v", err)
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.requests++
+		status := http.StatusOK
+		if len(w.statuses) > 0 {
+			status, w.statuses = w.statuses[0], w.statuses[1:]
+		}
+		if status == http.StatusOK {
+			var names []string
+			for _, e := range events {
+				names = append(names, e.Event.Name)
+			}
+			w.batches = append(w.batches, names)
+		}
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// delivered returns the number of events accepted by the webhook
+func (w *webhook) delivered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, b := range w.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func (w *webhook) requestCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.requests
+}
+
+// newTestHTTPSink returns an HTTPSink like NewHTTPSink does, but whose
+// buffer is not registered in the metrics so tests can create several
+func newTestHTTPSink(url string, batchSize int, retry *RetryPolicy) *HTTPSink {
+	client := pester.New()
+	client.MaxRetries = 1
+	client.Timeout = time.Second
+	return &HTTPSink{
+		client:    client,
+		url:       url,
+		headers:   http.Header{},
+		batchSize: batchSize,
+		retry:     retry,
+		bodyBuf:   &bytes.Buffer{},
+		eventCh:   &eventChannel{sink: httpSinkName, mem: channels.NewNativeChannel(100)},
+		heartbeat: newSinkHeartbeat(httpSinkName),
+	}
+}
+
+func newTestEventData(name string) EventData {
+	return EventData{
+		Verb:  "ADDED",
+		Event: &v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}},
+	}
+}
+
+// waitFor polls cond until it returns true or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHTTPSinkBatching(t *testing.T) {
+	w := newWebhook(t)
+	h := newTestHTTPSink(w.URL, 2, nil)
+	for i := 0; i < 5; i++ {
+		h.UpdateEvents(newTestEventData(fmt.Sprintf("e%d", i)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+	waitFor(t, "5 events", func() bool { return w.delivered() == 5 })
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	want := [][]string{{"e0", "e1"}, {"e2", "e3"}, {"e4"}}
+	if fmt.Sprint(w.batches) != fmt.Sprint(want) {
+		t.Errorf("Got batches %v, want %v", w.batches, want)
+	}
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		wantRequests  int
+		wantDelivered int
+	}{
+		{"success", nil, 1, 1},
+		{"retries 5xx", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, 3, 1},
+		{"retries 429", []int{http.StatusTooManyRequests}, 2, 1},
+		{"gives up after max attempts", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, 3, 0},
+		{"gives up on 4xx", []int{http.StatusBadRequest}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWebhook(t, tt.statuses...)
+			retry, err := NewRetryPolicy(3, time.Millisecond, 5*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newTestHTTPSink(w.URL, 10, retry)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go h.Run(ctx)
+			h.UpdateEvents(newTestEventData("failing"))
+			waitFor(t, "the requests", func() bool { return w.requestCount() >= tt.wantRequests })
+
+			// The sink moves on to the next event whatever happened to the
+			// previous one
+			h.UpdateEvents(newTestEventData("next"))
+			waitFor(t, "the next event", func() bool { return w.delivered() == tt.wantDelivered+1 })
+			if got := w.requestCount(); got != tt.wantRequests+1 {
+				t.Errorf("Got %d requests, want %d", got, tt.wantRequests+1)
+			}
+		})
+	}
+}
+
+func TestHTTPSinkDrainsOnShutdown(t *testing.T) {
+	w := newWebhook(t)
+	h := newTestHTTPSink(w.URL, 10, nil)
+	for i := 0; i < 25; i++ {
+		h.UpdateEvents(newTestEventData(fmt.Sprintf("e%d", i)))
+	}
+
+	// The sink is stopped before it gets to the buffered events, it must
+	// still send all of them before Run returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after ctx was done")
+	}
+	if got := w.delivered(); got != 25 {
+		t.Errorf("Got %d events delivered, want 25", got)
+	}
+}
+
+func TestHTTPSinkDiskQueueFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// wantDelivered is the events the webhook accepts, in order
+		wantDelivered []string
+	}{
+		{"sends again after a 5xx", []int{http.StatusServiceUnavailable}, []string{"failing", "next"}},
+		{"gives up on 4xx", []int{http.StatusBadRequest}, []string{"next"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWebhook(t, tt.statuses...)
+			h := newTestHTTPSink(w.URL, 10, nil)
+			q, err := newDiskQueue(t.TempDir(), httpSinkName, 1024*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.eventCh = &eventChannel{sink: httpSinkName, disk: q}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				h.Run(ctx)
+				close(done)
+			}()
+			h.UpdateEvents(newTestEventData("failing"))
+			waitFor(t, "the first request", func() bool { return w.requestCount() >= 1 })
+			h.UpdateEvents(newTestEventData("next"))
+			waitFor(t, "the events", func() bool { return w.delivered() == len(tt.wantDelivered) })
+			cancel()
+			<-done
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			var delivered []string
+			for _, b := range w.batches {
+				delivered = append(delivered, b...)
+			}
+			if fmt.Sprint(delivered) != fmt.Sprint(tt.wantDelivered) {
+				t.Errorf("Got events %v delivered, want %v", delivered, tt.wantDelivered)
+			}
+			if q.Len() != 0 {
+				t.Errorf("Got %d events left in the queue, want none", q.Len())
+			}
+		})
+	}
+}
+
+func TestHTTPSinkContentType(t *testing.T) {
+	template, err := newMessageTemplate(httpSinkName, "{{.Event.Name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		template *messageTemplate
+		header   string
+		want     string
+	}{
+		{name: "json", want: "application/json"},
+		{name: "template", template: template, want: "text/plain; charset=utf-8"},
+		{name: "template with header", template: template, header: "application/json", want: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Content-Type")
+			}))
+			defer server.Close()
+
+			h := newTestHTTPSink(server.URL, 1, nil)
+			h.template = tt.template
+			if tt.header != "" {
+				h.headers.Set("Content-Type", tt.header)
+			}
+			if err := h.upload([]EventData{newTestEventData("e")}); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Got Content-Type %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
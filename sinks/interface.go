@@ -3,26 +3,98 @@ package sinks
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
-	v1 "k8s.io/api/core/v1"
-	log "k8s.io/klog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
 )
 
 const (
 	sink             string = "SINK"
 	logGroupNameEnv  string = "CW_LOG_GROUP_NAME"
 	logStreamNameEnv string = "CW_LOG_STREAM_NAME"
+	httpURLEnv       string = "HTTP_SINK_URL"
+	httpHeadersEnv   string = "HTTP_SINK_HEADERS"
+	syslogAddressEnv string = "SYSLOG_SINK_ADDRESS"
+	logFilePathEnv   string = "LOGFILE_SINK_PATH"
+)
+
+// Sink names, as listed in the SINK Env variable
+const (
+	stdoutSinkName  = "stdoutsink"
+	cwlSinkName     = "CWL"
+	httpSinkName    = "http"
+	syslogSinkName  = "syslog"
+	logFileSinkName = "logfile"
+)
+
+// The Run loop of every sink reports to the liveness probe every
+// heartbeatInterval, it is considered stalled after sinkStallTimeout
+const (
+	heartbeatInterval = 10 * time.Second
+	sinkStallTimeout  = 5 * time.Minute
 )
 
 // EventSinkInterface is the interface used to shunt events
 type EventSinkInterface interface {
-	UpdateEvents(eNew *v1.Event, eOld *v1.Event)
+	UpdateEvents(eData EventData)
 }
 
-// ManufactureSink will manufacture a sink according to viper configs
-func ManufactureSink(ctx context.Context) (e EventSinkInterface) {
+// Checker is implemented by sinks that can check they are able to reach
+// their destination
+type Checker interface {
+	Check() error
+}
+
+// CheckSink checks the connectivity of the sink, if it implements Checker
+func CheckSink(s EventSinkInterface) error {
+	if c, ok := s.(Checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// newSinkBackoff returns the backoff between attempts of a sink to reach its
+// destination
+func newSinkBackoff() *wait.Backoff {
+	return &wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      time.Minute,
+	}
+}
+
+// newSinkHeartbeat registers the liveness heartbeat of the named sink. The
+// Run loop of the sink beats it to tell the liveness probe it is not stalled.
+func newSinkHeartbeat(name string) *health.Heartbeat {
+	return health.NewHeartbeat(fmt.Sprintf("sink %s", name), sinkStallTimeout)
+}
+
+// ManufactureSink will manufacture a sink according to viper configs. If
+// several sinks are configured the returned sink delivers every event to each
+// of them. See ManufactureSinks for ctx and wg.
+func ManufactureSink(ctx context.Context, wg *sync.WaitGroup) EventSinkInterface {
+	return NewMultiSink(ManufactureSinks(ctx, wg))
+}
+
+// ManufactureSinks will manufacture every sink listed in the SINK Env
+// variable, keyed by name. If more than one sink is configured each of them
+// gets its own buffer, so a slow or failing sink does not block the others.
+// The sinks run until ctx is done, then flush the events they still buffer
+// and mark themselves done in wg.
+func ManufactureSinks(ctx context.Context, wg *sync.WaitGroup) map[string]EventSinkInterface {
 	s, ok := os.LookupEnv(sink)
 	if !ok || s == "" {
 		log.Warningf("SINK is not set! Setting it to CloudWatchLogs")
@@ -30,43 +102,316 @@ func ManufactureSink(ctx context.Context) (e EventSinkInterface) {
 		s = viper.GetString("SINK")
 	}
 	log.Infof("Sink is [%v]", s)
-	switch s {
-	case "stdoutsink":
-		e = NewStdoutSink(ctx)
 
-	case "CWL":
+	// By default we buffer up to 1500 events, and drop messages if more than
+	// 1500 have come in without getting consumed
+	viper.SetDefault("sinkBufferSize", 1500)
+	viper.SetDefault("sinkDiscardMessages", true)
+
+	// With SINK_QUEUE_DIR set the sinks buffer on disk instead, up to
+	// SINK_QUEUE_MAX_SIZE_MB each
+	bindEnv("sinkQueueDir", "SINK_QUEUE_DIR", "")
+	bindEnv("sinkQueueMaxSizeMB", "SINK_QUEUE_MAX_SIZE_MB", 1024)
+
+	// Failed uploads are retried SINK_RETRY_MAX_ATTEMPTS times in total, and
+	// then written to SINK_DEAD_LETTER_DIR if set
+	bindEnv("sinkRetryMaxAttempts", "SINK_RETRY_MAX_ATTEMPTS", 5)
+	bindEnv("sinkRetryInitialBackoff", "SINK_RETRY_INITIAL_BACKOFF", 1)
+	bindEnv("sinkRetryMaxBackoff", "SINK_RETRY_MAX_BACKOFF", 30)
+	bindEnv("sinkDeadLetterDir", "SINK_DEAD_LETTER_DIR", "")
+
+	// The payload of every sink is shaped by the SINK_PAYLOAD_* Env variables
+	bindEnv("sinkPayloadInclude", "SINK_PAYLOAD_INCLUDE", "")
+	bindEnv("sinkPayloadExclude", "SINK_PAYLOAD_EXCLUDE", "")
+	bindEnv("sinkPayloadOldEvent", "SINK_PAYLOAD_OLD_EVENT", OldEventFull)
+	bindEnv("sinkPayloadCompact", "SINK_PAYLOAD_COMPACT", false)
+	err := SetPayloadOptions(PayloadOptions{
+		Include:  strings.Split(viper.GetString("sinkPayloadInclude"), ","),
+		Exclude:  strings.Split(viper.GetString("sinkPayloadExclude"), ","),
+		OldEvent: viper.GetString("sinkPayloadOldEvent"),
+		Compact:  viper.GetBool("sinkPayloadCompact"),
+	})
+	if err != nil {
+		log.Exitf("Invalid sink payload configuration: %v", err)
+	}
+
+	names := sinkNames(s)
+	if len(names) == 0 {
+		log.Fatalf("Invalid Sink Specified [%v], exiting program...", s)
+	}
+	if len(names) == 1 {
+		return map[string]EventSinkInterface{names[0]: manufactureSink(ctx, wg, names[0])}
+	}
+
+	bufferSize := viper.GetInt("sinkBufferSize")
+	overflow := viper.GetBool("sinkDiscardMessages")
+
+	// The sinks are only stopped once the buffers in front of them have been
+	// drained into them
+	sinkCtx, stopSinks := context.WithCancel(context.Background())
+	var buffers sync.WaitGroup
+
+	sinks := make(map[string]EventSinkInterface, len(names))
+	for _, name := range names {
+		if _, ok := sinks[name]; ok {
+			log.Exitf("Sink %v is configured more than once", name)
+		}
+		b := newBufferedSink(name, manufactureSink(sinkCtx, wg, name), overflow, bufferSize)
+		runSink(ctx, &buffers, b.Run)
+		sinks[name] = b
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		buffers.Wait()
+		stopSinks()
+	}()
+	return sinks
+}
+
+// enableDiskQueue moves the buffer of a sink to its own directory under
+// SINK_QUEUE_DIR, if set
+func enableDiskQueue(c *eventChannel) {
+	dir := viper.GetString("sinkQueueDir")
+	if dir == "" {
+		return
+	}
+	maxSize := int64(viper.GetInt("sinkQueueMaxSizeMB")) * 1024 * 1024
+	if err := c.persist(filepath.Join(dir, c.sink), maxSize); err != nil {
+		log.Fatalf("Failed to open disk queue: %v", err)
+	}
+}
+
+// newRetryPolicyFromConfig returns the retry policy configured by the
+// SINK_RETRY_* Env variables, with maxAttempts overriding
+// SINK_RETRY_MAX_ATTEMPTS if positive
+func newRetryPolicyFromConfig(maxAttempts int) *RetryPolicy {
+	if maxAttempts <= 0 {
+		maxAttempts = viper.GetInt("sinkRetryMaxAttempts")
+	}
+	initialBackoff := time.Second * time.Duration(viper.GetInt("sinkRetryInitialBackoff"))
+	maxBackoff := time.Second * time.Duration(viper.GetInt("sinkRetryMaxBackoff"))
+	retry, err := NewRetryPolicy(maxAttempts, initialBackoff, maxBackoff)
+	if err != nil {
+		log.Exitf("Invalid sink retry configuration: %v", err)
+	}
+	return retry
+}
+
+// newDeadLetterFromConfig opens the dead letter file of the named sink under
+// SINK_DEAD_LETTER_DIR, or returns nil if it is not set
+func newDeadLetterFromConfig(name string) *deadLetter {
+	dir := viper.GetString("sinkDeadLetterDir")
+	if dir == "" {
+		return nil
+	}
+	d, err := newDeadLetter(dir, name)
+	if err != nil {
+		log.Fatalf("Failed to open dead letter file: %v", err)
+	}
+	return d
+}
+
+// newMessageTemplateFromConfig parses the message template of the named sink
+// from the given Env variable, or returns nil if it is not set
+func newMessageTemplateFromConfig(name string, key string, env string) *messageTemplate {
+	bindEnv(key, env, "")
+	t, err := newMessageTemplate(name, viper.GetString(key))
+	if err != nil {
+		log.Exitf("Invalid %s: %v", env, err)
+	}
+	return t
+}
+
+// runSink starts the Run loop of a sink, tracking it in wg
+func runSink(ctx context.Context, wg *sync.WaitGroup, run func(ctx context.Context)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx)
+	}()
+}
+
+// manufactureSink will manufacture a single sink by name
+func manufactureSink(ctx context.Context, wg *sync.WaitGroup, name string) (e EventSinkInterface) {
+	switch name {
+	case stdoutSinkName:
+		ss := NewStdoutSink()
+		ss.template = newMessageTemplateFromConfig(stdoutSinkName, "stdoutSinkTemplate", "STDOUT_SINK_TEMPLATE")
+		runSink(ctx, wg, ss.Run)
+		e = ss
+
+	case cwlSinkName:
 		logGroupName, ok := os.LookupEnv(logGroupNameEnv)
 		if !ok || logGroupName == "" {
 			log.Exitf("Missing CWL Log Group, please set CW_LOG_GROUP_NAME Env variable")
 		}
 
+		bindEnv("cwlAutoCreate", "CW_AUTO_CREATE", false)
+		bindEnv("cwlRetentionInDays", "CW_LOG_RETENTION_DAYS", 0)
+		bindEnv("cwlKMSKeyID", "CW_LOG_KMS_KEY_ID", "")
+		bindEnv("cwlEventTimestamps", "CW_USE_EVENT_TIMESTAMPS", false)
+		autoCreate := viper.GetBool("cwlAutoCreate")
+
 		logStreamName, ok := os.LookupEnv(logStreamNameEnv)
-		if !ok || logGroupName == "" {
-			log.Exitf("Missing CWL Log Stream, please set CW_LOG_STREAM_NAME Env variable")
+		if !ok || logStreamName == "" {
+			if !autoCreate {
+				log.Exitf("Missing CWL Log Stream, please set CW_LOG_STREAM_NAME Env variable")
+			}
+			logStreamName = "eventData" + uuid.New().String()
+			log.Infof("CW_LOG_STREAM_NAME is not set, using log stream %s", logStreamName)
 		}
-		// By default we buffer up to 1500 events, and drop messages if more than
-		// 1500 have come in without getting consumed
-		viper.SetDefault("sinkBufferSize", 1500)
-		viper.SetDefault("sinkDiscardMessages", true)
-
 		viper.SetDefault("sinkUploadInterval", 5)
 		uploadInterval := viper.GetInt("sinkUploadInterval")
 
 		bufferSize := viper.GetInt("sinkBufferSize")
 		overflow := viper.GetBool("sinkDiscardMessages")
 
-		cwl, err := NewCWLSink(logGroupName, logStreamName, uploadInterval, overflow, bufferSize)
+		cwl, err := NewCWLSink(logGroupName, logStreamName, uploadInterval, newRetryPolicyFromConfig(0), overflow, bufferSize)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		cwl.deadLetter = newDeadLetterFromConfig(cwlSinkName)
+		cwl.eventTimestamps = viper.GetBool("cwlEventTimestamps")
+		cwl.template = newMessageTemplateFromConfig(cwlSinkName, "cwlTemplate", "CW_TEMPLATE")
+
+		if cwl.logStreamTemplate != nil && !autoCreate {
+			log.Warningf("CW_LOG_STREAM_NAME is a template but CW_AUTO_CREATE is not set, every log stream it renders must already exist")
+		}
+		if autoCreate {
+			err = cwl.EnableAutoCreate(int64(viper.GetInt("cwlRetentionInDays")), viper.GetString("cwlKMSKeyID"))
+			if err != nil {
+				log.Warningf("Failed to create CloudWatch Logs resources, retrying on upload: %v", err)
+			}
+		}
 
-		go cwl.Run(make(chan bool))
+		enableDiskQueue(cwl.eventCh)
+		runSink(ctx, wg, cwl.Run)
 		return cwl
 
-	// case "logfile"
+	case httpSinkName:
+		url, ok := os.LookupEnv(httpURLEnv)
+		if !ok || url == "" {
+			log.Exitf("Missing HTTP sink URL, please set HTTP_SINK_URL Env variable")
+		}
+
+		headers, err := parseHeaders(os.Getenv(httpHeadersEnv))
+		if err != nil {
+			log.Exitf("Invalid HTTP_SINK_HEADERS: %v", err)
+		}
+
+		bindEnv("httpSinkBatchSize", "HTTP_SINK_BATCH_SIZE", 100)
+		bindEnv("httpSinkTimeout", "HTTP_SINK_TIMEOUT", 10)
+		// HTTP_SINK_MAX_RETRIES predates SINK_RETRY_MAX_ATTEMPTS and
+		// overrides it for this sink
+		bindEnv("httpSinkMaxRetries", "HTTP_SINK_MAX_RETRIES", 0)
+
+		batchSize := viper.GetInt("httpSinkBatchSize")
+		timeout := time.Second * time.Duration(viper.GetInt("httpSinkTimeout"))
+		retry := newRetryPolicyFromConfig(viper.GetInt("httpSinkMaxRetries"))
+
+		bufferSize := viper.GetInt("sinkBufferSize")
+		overflow := viper.GetBool("sinkDiscardMessages")
+
+		h, err := NewHTTPSink(url, headers, batchSize, timeout, retry, overflow, bufferSize)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		h.deadLetter = newDeadLetterFromConfig(httpSinkName)
+		h.template = newMessageTemplateFromConfig(httpSinkName, "httpSinkTemplate", "HTTP_SINK_TEMPLATE")
+
+		enableDiskQueue(h.eventCh)
+		runSink(ctx, wg, h.Run)
+		return h
+
+	case syslogSinkName:
+		address, ok := os.LookupEnv(syslogAddressEnv)
+		if !ok || address == "" {
+			log.Exitf("Missing syslog address, please set SYSLOG_SINK_ADDRESS Env variable")
+		}
+
+		bindEnv("syslogSinkNetwork", "SYSLOG_SINK_NETWORK", "tcp")
+		bindEnv("syslogSinkTLSCAFile", "SYSLOG_SINK_TLS_CA_FILE", "")
+		bindEnv("syslogSinkTLSInsecureSkipVerify", "SYSLOG_SINK_TLS_INSECURE_SKIP_VERIFY", false)
+
+		network := viper.GetString("syslogSinkNetwork")
+		tlsConfig, err := newSyslogTLSConfig(viper.GetString("syslogSinkTLSCAFile"), viper.GetBool("syslogSinkTLSInsecureSkipVerify"))
+		if err != nil {
+			log.Exitf("Invalid syslog TLS configuration: %v", err)
+		}
+
+		bufferSize := viper.GetInt("sinkBufferSize")
+		overflow := viper.GetBool("sinkDiscardMessages")
+
+		ss, err := NewSyslogSink(network, address, tlsConfig, newRetryPolicyFromConfig(0), overflow, bufferSize)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		ss.deadLetter = newDeadLetterFromConfig(syslogSinkName)
+		ss.template = newMessageTemplateFromConfig(syslogSinkName, "syslogSinkTemplate", "SYSLOG_SINK_TEMPLATE")
+
+		enableDiskQueue(ss.eventCh)
+		runSink(ctx, wg, ss.Run)
+		return ss
+
+	case logFileSinkName:
+		path, ok := os.LookupEnv(logFilePathEnv)
+		if !ok || path == "" {
+			log.Exitf("Missing log file path, please set LOGFILE_SINK_PATH Env variable")
+		}
+
+		bindEnv("logFileSinkFormat", "LOGFILE_SINK_FORMAT", "json")
+		bindEnv("logFileSinkMaxSizeMB", "LOGFILE_SINK_MAX_SIZE_MB", 100)
+		bindEnv("logFileSinkMaxAgeHours", "LOGFILE_SINK_MAX_AGE_HOURS", 24)
+		bindEnv("logFileSinkMaxBackups", "LOGFILE_SINK_MAX_BACKUPS", 5)
+		bindEnv("logFileSinkCompress", "LOGFILE_SINK_COMPRESS", false)
+		bindEnv("logFileSinkSyncInterval", "LOGFILE_SINK_SYNC_INTERVAL", 5)
+
+		maxSize := int64(viper.GetInt("logFileSinkMaxSizeMB")) * 1024 * 1024
+		maxAge := time.Hour * time.Duration(viper.GetInt("logFileSinkMaxAgeHours"))
+		syncInterval := time.Second * time.Duration(viper.GetInt("logFileSinkSyncInterval"))
+
+		file, err := newRotatingFile(path, maxSize, maxAge, viper.GetInt("logFileSinkMaxBackups"), viper.GetBool("logFileSinkCompress"))
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+
+		bufferSize := viper.GetInt("sinkBufferSize")
+		overflow := viper.GetBool("sinkDiscardMessages")
+
+		fs, err := NewFileSink(file, viper.GetString("logFileSinkFormat"), syncInterval, overflow, bufferSize)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fs.template = newMessageTemplateFromConfig(logFileSinkName, "logFileSinkTemplate", "LOGFILE_SINK_TEMPLATE")
+
+		enableDiskQueue(fs.eventCh)
+		runSink(ctx, wg, fs.Run)
+		return fs
+
 	default:
 		err := errors.New("Invalid Sink Specified")
-		log.Fatalf("%v, Sink variable not set, exiting program...", err.Error())
+		log.Fatalf("%v [%v], Sink variable not set, exiting program...", err.Error(), name)
 	}
 	return e
 }
+
+// sinkNames splits a comma separated list of sink names
+func sinkNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// bindEnv sets the default for a viper key and allows it to be overridden by
+// the given environment variable
+func bindEnv(key string, env string, value interface{}) {
+	viper.SetDefault(key, value)
+	viper.BindEnv(key, env)
+}
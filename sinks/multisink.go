@@ -0,0 +1,116 @@
+package sinks
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
+)
+
+// MultiSink is the sink that fans out every event to several sinks
+type MultiSink struct {
+	sinks []EventSinkInterface
+}
+
+// NewMultiSink is the factory method constructing a new MultiSink. The sinks
+// should not block, see newBufferedSink.
+func NewMultiSink(sinks map[string]EventSinkInterface) *MultiSink {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ms := &MultiSink{}
+	for _, name := range names {
+		ms.sinks = append(ms.sinks, sinks[name])
+	}
+	return ms
+}
+
+// UpdateEvents implements the EventSinkInterface. It hands the event to
+// every sink.
+func (ms *MultiSink) UpdateEvents(eData EventData) {
+	for _, s := range ms.sinks {
+		s.UpdateEvents(eData)
+	}
+}
+
+/*
+bufferedSink wraps a sink with its own buffer and goroutine, so that when
+several sinks are in use a slow or failing sink never blocks delivery to the
+others. Events that do not fit into the buffer are dropped for this sink only
+and counted, as are deliveries that panic in the wrapped sink. The buffer is
+always in memory, in front of the disk queue of the wrapped sink if it has
+one, so it may drop events even with SINK_QUEUE_DIR set.
+*/
+type bufferedSink struct {
+	name string
+	sink EventSinkInterface
+
+	// eventCh buffers the events not yet handed to the wrapped sink
+	eventCh *eventChannel
+
+	heartbeat *health.Heartbeat
+}
+
+func newBufferedSink(name string, sink EventSinkInterface, overflow bool, bufferSize int) *bufferedSink {
+	return &bufferedSink{
+		name:      name,
+		sink:      sink,
+		eventCh:   newEventChannel(name, "fanout", overflow, bufferSize),
+		heartbeat: newSinkHeartbeat(name + " fanout"),
+	}
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the buffer, which with discarding enabled never blocks.
+func (b *bufferedSink) UpdateEvents(eData EventData) {
+	b.eventCh.send(eData)
+}
+
+// Run sits in a loop handing buffered events to the wrapped sink. When ctx is
+// done the remaining events are handed over before Run returns.
+func (b *bufferedSink) Run(ctx context.Context) {
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case e := <-b.eventCh.Out():
+			evt, ok := b.eventCh.event(e)
+			if !ok {
+				continue
+			}
+			b.deliver(evt)
+		case <-heartbeatTicker.C:
+			b.heartbeat.Beat()
+		case <-ctx.Done():
+			for _, evt := range b.eventCh.drain() {
+				b.deliver(evt)
+			}
+			return
+		}
+	}
+}
+
+// Check implements the Checker interface by checking the wrapped sink
+func (b *bufferedSink) Check() error {
+	return CheckSink(b.sink)
+}
+
+// deliver hands a single event to the wrapped sink, making sure a panic in
+// one sink does not take down the others
+func (b *bufferedSink) deliver(eData EventData) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.ExportFailures.WithLabelValues(b.name, "panic").Inc()
+			log.Errorf("Sink %v panicked handling event: %v", b.name, r)
+		}
+	}()
+	b.sink.UpdateEvents(eData)
+}
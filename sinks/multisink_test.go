@@ -0,0 +1,129 @@
+package sinks
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/event-exporter/metrics"
+)
+
+// recordingSink records the names of the events it is handed
+type recordingSink struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *recordingSink) UpdateEvents(eData EventData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, eData.Event.Name)
+}
+
+func (r *recordingSink) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+// blockingSink blocks on every event until unblock is closed
+type blockingSink struct {
+	unblock chan struct{}
+}
+
+func (b *blockingSink) UpdateEvents(EventData) {
+	<-b.unblock
+}
+
+// panickingSink panics on every event
+type panickingSink struct{}
+
+func (panickingSink) UpdateEvents(EventData) {
+	panic("broken sink")
+}
+
+// runBufferedSink runs the sink until the returned stop function is called,
+// which waits for Run to return
+func runBufferedSink(b *bufferedSink) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestMultiSinkFanout(t *testing.T) {
+	a, b := &recordingSink{}, &recordingSink{}
+	ms := NewMultiSink(map[string]EventSinkInterface{"a": a, "b": b})
+	for _, name := range []string{"1", "2", "3"} {
+		ms.UpdateEvents(newTestEventData(name))
+	}
+	for _, r := range []*recordingSink{a, b} {
+		if got := r.received(); len(got) != 3 || got[0] != "1" || got[2] != "3" {
+			t.Errorf("Got events %v, want 1, 2 and 3 in order", got)
+		}
+	}
+}
+
+func TestBufferedSinkIndependentFailure(t *testing.T) {
+	const n = 50
+	healthy := &recordingSink{}
+	blocked := &blockingSink{unblock: make(chan struct{})}
+	panics := metrics.ExportFailures.WithLabelValues("test-panicked", "panic")
+	healthyDrops := metrics.EventsDropped.WithLabelValues("test-healthy")
+	blockedDrops := metrics.EventsDropped.WithLabelValues("test-blocked")
+	panicsBefore, healthyDropsBefore, blockedDropsBefore := testutil.ToFloat64(panics), testutil.ToFloat64(healthyDrops), testutil.ToFloat64(blockedDrops)
+
+	buffered := map[string]*bufferedSink{
+		"test-healthy":  newBufferedSink("test-healthy", healthy, true, n),
+		"test-blocked":  newBufferedSink("test-blocked", blocked, true, 10),
+		"test-panicked": newBufferedSink("test-panicked", panickingSink{}, true, n),
+	}
+	children := map[string]EventSinkInterface{}
+	for name, b := range buffered {
+		defer runBufferedSink(b)()
+		children[name] = b
+	}
+	// The blocked sink has to be released before it can be stopped
+	defer close(blocked.unblock)
+	ms := NewMultiSink(children)
+
+	// The blocked sink fills its buffer and drops the rest, while the others
+	// keep receiving every event
+	for i := 0; i < n; i++ {
+		ms.UpdateEvents(newTestEventData("e"))
+	}
+	waitFor(t, "the healthy sink", func() bool { return len(healthy.received()) == n })
+	waitFor(t, "the panicking sink", func() bool {
+		return testutil.ToFloat64(panics)-panicsBefore == n
+	})
+	if dropped := testutil.ToFloat64(blockedDrops) - blockedDropsBefore; dropped == 0 {
+		t.Error("Got no events dropped for the blocked sink, want some")
+	}
+	if dropped := testutil.ToFloat64(healthyDrops) - healthyDropsBefore; dropped != 0 {
+		t.Errorf("Got %v events dropped for the healthy sink, want none", dropped)
+	}
+}
+
+func TestBufferedSinkDrainsOnStop(t *testing.T) {
+	r := &recordingSink{}
+	b := newBufferedSink("test-drain", r, false, 10)
+	for _, name := range []string{"1", "2", "3"} {
+		b.UpdateEvents(newTestEventData(name))
+	}
+
+	// Run hands the buffered events over even when it is stopped right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+	if got := r.received(); len(got) != 3 {
+		t.Errorf("Got events %v after stopping, want all 3", got)
+	}
+}
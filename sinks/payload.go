@@ -0,0 +1,295 @@
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Values of PayloadOptions.OldEvent
+const (
+	// OldEventFull exports the previous version of updated events as is
+	OldEventFull = "full"
+	// OldEventDrop does not export the previous version of updated events
+	OldEventDrop = "drop"
+	// OldEventDiff exports the previous values of the fields that changed as
+	// old_event_diff instead of the previous version of updated events
+	OldEventDiff = "diff"
+)
+
+// PayloadOptions shape the JSON payload every sink exports for an event.
+// Fields are addressed by JSON paths of dot separated keys, e.g.
+// event.metadata.managedFields, where * matches any key. Paths apply to
+// every element of the arrays they traverse.
+type PayloadOptions struct {
+	// Include lists the paths of the fields to export, if empty every field
+	// is exported
+	Include []string
+	// Exclude lists the paths of the fields not to export
+	Exclude []string
+	// OldEvent is one of OldEventFull, OldEventDrop or OldEventDiff
+	OldEvent string
+	// Compact leaves out the fields that are null, empty strings or empty
+	// objects and arrays
+	Compact bool
+}
+
+// payloadShape is the compiled form of PayloadOptions, its zero value
+// exports the event data as is
+type payloadShape struct {
+	include  [][]string
+	exclude  [][]string
+	oldEvent string
+	compact  bool
+}
+
+// sinkPayload shapes the payload of every sink, see SetPayloadOptions
+var sinkPayload payloadShape
+
+// SetPayloadOptions sets the shape of the payload exported by every sink. It
+// must be called before the sinks are started.
+func SetPayloadOptions(opts PayloadOptions) error {
+	shape := payloadShape{
+		oldEvent: opts.OldEvent,
+		compact:  opts.Compact,
+	}
+	switch opts.OldEvent {
+	case "", OldEventFull:
+		shape.oldEvent = ""
+	case OldEventDrop, OldEventDiff:
+	default:
+		return fmt.Errorf("unsupported old event mode %q, must be one of full, drop or diff", opts.OldEvent)
+	}
+
+	var err error
+	if shape.include, err = parsePaths(opts.Include); err != nil {
+		return err
+	}
+	if shape.exclude, err = parsePaths(opts.Exclude); err != nil {
+		return err
+	}
+	sinkPayload = shape
+	return nil
+}
+
+// parsePaths splits the JSON paths into their keys
+func parsePaths(paths []string) ([][]string, error) {
+	var parsed [][]string
+	for _, p := range paths {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		keys := strings.Split(p, ".")
+		for _, k := range keys {
+			if k == "" {
+				return nil, fmt.Errorf("invalid payload field path %q", p)
+			}
+		}
+		parsed = append(parsed, keys)
+	}
+	return parsed, nil
+}
+
+// isZero returns true if the payload is not shaped
+func (s *payloadShape) isZero() bool {
+	return len(s.include) == 0 && len(s.exclude) == 0 && s.oldEvent == "" && !s.compact
+}
+
+// marshalEventData returns the JSON payload the sinks export for the event
+// data, shaped according to the payload options
+func marshalEventData(e *EventData) ([]byte, error) {
+	if sinkPayload.isZero() {
+		return json.Marshal(e)
+	}
+	m, err := sinkPayload.shape(e)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// shape returns the event data as a generic JSON object, shaped according
+// to the payload options
+func (s *payloadShape) shape(e *EventData) (map[string]interface{}, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	switch s.oldEvent {
+	case OldEventDrop:
+		delete(m, "old_event")
+	case OldEventDiff:
+		if old, ok := m["old_event"]; ok {
+			m["old_event_diff"] = diffValues(m["event"], old)
+			delete(m, "old_event")
+		}
+	}
+
+	var v interface{} = m
+	if len(s.include) > 0 {
+		v, _ = selectPaths(v, s.include)
+	}
+	if len(s.exclude) > 0 {
+		v = removePaths(v, s.exclude)
+	}
+	if s.compact {
+		v, _ = compactValue(v)
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+// matchingTails returns the remainders of the paths whose first key matches
+// key
+func matchingTails(key string, paths [][]string) [][]string {
+	var tails [][]string
+	for _, p := range paths {
+		if p[0] == key || p[0] == "*" {
+			tails = append(tails, p[1:])
+		}
+	}
+	return tails
+}
+
+// selectPaths returns the parts of v addressed by the paths, and false if
+// there are none
+func selectPaths(v interface{}, paths [][]string) (interface{}, bool) {
+	for _, p := range paths {
+		if len(p) == 0 {
+			return v, true
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		selected := make(map[string]interface{})
+		for k, child := range v {
+			tails := matchingTails(k, paths)
+			if len(tails) == 0 {
+				continue
+			}
+			if c, ok := selectPaths(child, tails); ok {
+				selected[k] = c
+			}
+		}
+		return selected, len(selected) > 0
+	case []interface{}:
+		var selected []interface{}
+		for _, child := range v {
+			if c, ok := selectPaths(child, paths); ok {
+				selected = append(selected, c)
+			}
+		}
+		return selected, len(selected) > 0
+	}
+	// The paths go deeper than v
+	return nil, false
+}
+
+// removePaths removes the parts of v addressed by the paths
+func removePaths(v interface{}, paths [][]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			tails := matchingTails(k, paths)
+			removed := false
+			var deeper [][]string
+			for _, t := range tails {
+				if len(t) == 0 {
+					removed = true
+					break
+				}
+				deeper = append(deeper, t)
+			}
+			if removed {
+				delete(v, k)
+			} else if len(deeper) > 0 {
+				v[k] = removePaths(child, deeper)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = removePaths(child, paths)
+		}
+	}
+	return v
+}
+
+// compactValue leaves out null values, empty strings and empty objects and
+// arrays, it returns false if v itself is left out
+func compactValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != ""
+	case map[string]interface{}:
+		for k, child := range v {
+			if c, ok := compactValue(child); ok {
+				v[k] = c
+			} else {
+				delete(v, k)
+			}
+		}
+		return v, len(v) > 0
+	case []interface{}:
+		compacted := v[:0]
+		for _, child := range v {
+			if c, ok := compactValue(child); ok {
+				compacted = append(compacted, c)
+			}
+		}
+		return compacted, len(compacted) > 0
+	}
+	return v, true
+}
+
+// diffValues returns the previous values of the fields that differ between
+// the current and the previous version of an object, keyed by their dot
+// separated path. Fields the previous version did not have are null.
+func diffValues(current interface{}, previous interface{}) map[string]interface{} {
+	cur := make(map[string]interface{})
+	flattenValue("", current, cur)
+	prev := make(map[string]interface{})
+	flattenValue("", previous, prev)
+
+	diff := make(map[string]interface{})
+	for path, p := range prev {
+		if c, ok := cur[path]; !ok || !reflect.DeepEqual(c, p) {
+			diff[path] = p
+		}
+	}
+	for path := range cur {
+		if _, ok := prev[path]; !ok {
+			diff[path] = nil
+		}
+	}
+	return diff
+}
+
+// flattenValue stores the leaves of v in flat, keyed by their dot separated
+// path. Arrays are leaves.
+func flattenValue(prefix string, v interface{}, flat map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		if prefix != "" {
+			flat[prefix] = v
+		}
+		return
+	}
+	for k, child := range m {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		flattenValue(path, child, flat)
+	}
+}
@@ -0,0 +1,166 @@
+package sinks
+
+import (
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setPayloadOptions sets the payload options for the test, and resets them
+// once it is done
+func setPayloadOptions(t *testing.T, opts PayloadOptions) {
+	t.Helper()
+	if err := SetPayloadOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sinkPayload = payloadShape{} })
+}
+
+// newTestUpdate returns the event data of an update of the count, message and
+// action of an event
+func newTestUpdate() EventData {
+	owners := []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "a"}, {Kind: "ReplicaSet", Name: "b"}}
+	return NewEventData(&v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "e", ResourceVersion: "2", OwnerReferences: owners},
+		Reason:     "BackOff",
+		Message:    "new",
+		Count:      2,
+		Action:     "Pulling",
+	}, &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "e", ResourceVersion: "1", OwnerReferences: owners},
+		Reason:     "BackOff",
+		Message:    "old",
+		Count:      1,
+	})
+}
+
+func TestSetPayloadOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    PayloadOptions
+		wantErr bool
+	}{
+		{"zero", PayloadOptions{}, false},
+		{"full old event", PayloadOptions{OldEvent: OldEventFull}, false},
+		{"paths", PayloadOptions{Include: []string{"verb", " event.reason "}, Exclude: []string{"*.metadata"}}, false},
+		{"unsupported old event mode", PayloadOptions{OldEvent: "keep"}, true},
+		{"empty include key", PayloadOptions{Include: []string{"event..reason"}}, true},
+		{"empty exclude key", PayloadOptions{Exclude: []string{"event."}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() { sinkPayload = payloadShape{} }()
+			err := SetPayloadOptions(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarshalEventData(t *testing.T) {
+	tests := []struct {
+		name string
+		opts PayloadOptions
+		want string
+	}{
+		{
+			name: "include",
+			opts: PayloadOptions{Include: []string{"verb", "event.reason"}},
+			want: `{"event":{"reason":"BackOff"},"verb":"UPDATED"}`,
+		},
+		{
+			name: "include with wildcard",
+			opts: PayloadOptions{Include: []string{"*.message"}},
+			want: `{"event":{"message":"new"},"old_event":{"message":"old"}}`,
+		},
+		{
+			name: "include through arrays",
+			opts: PayloadOptions{Include: []string{"event.metadata.ownerReferences.name"}},
+			want: `{"event":{"metadata":{"ownerReferences":[{"name":"a"},{"name":"b"}]}}}`,
+		},
+		{
+			name: "include missing field",
+			opts: PayloadOptions{Include: []string{"verb", "event.reason.missing"}},
+			want: `{"verb":"UPDATED"}`,
+		},
+		{
+			name: "exclude",
+			opts: PayloadOptions{Include: []string{"event.reason", "event.message"}, Exclude: []string{"event.message"}},
+			want: `{"event":{"reason":"BackOff"}}`,
+		},
+		{
+			name: "exclude with wildcard",
+			opts: PayloadOptions{Include: []string{"verb", "event.metadata.name", "old_event.metadata.name"}, Exclude: []string{"*.metadata"}},
+			want: `{"event":{},"old_event":{},"verb":"UPDATED"}`,
+		},
+		{
+			name: "exclude through arrays",
+			opts: PayloadOptions{Include: []string{"event.metadata.ownerReferences"}, Exclude: []string{"event.metadata.ownerReferences.apiVersion", "event.metadata.ownerReferences.uid"}},
+			want: `{"event":{"metadata":{"ownerReferences":[{"kind":"ReplicaSet","name":"a"},{"kind":"ReplicaSet","name":"b"}]}}}`,
+		},
+		{
+			name: "drop old event",
+			opts: PayloadOptions{Include: []string{"verb", "old_event"}, OldEvent: OldEventDrop},
+			want: `{"verb":"UPDATED"}`,
+		},
+		{
+			name: "diff old event",
+			opts: PayloadOptions{Include: []string{"old_event", "old_event_diff"}, OldEvent: OldEventDiff},
+			want: `{"old_event_diff":{"action":null,"count":1,"message":"old","metadata.resourceVersion":"1"}}`,
+		},
+		{
+			name: "compact",
+			opts: PayloadOptions{Include: []string{"event.metadata.name", "event.metadata.creationTimestamp", "event.source"}, Compact: true},
+			want: `{"event":{"metadata":{"name":"e"}}}`,
+		},
+		{
+			name: "compact everything",
+			opts: PayloadOptions{Include: []string{"event.source"}, Compact: true},
+			want: `{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setPayloadOptions(t, tt.opts)
+			eData := newTestUpdate()
+			got, err := marshalEventData(&eData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Got payload %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalEventDataUnshaped(t *testing.T) {
+	eData := newTestUpdate()
+	got, err := marshalEventData(&eData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(&eData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("Got payload %s, want %s", got, want)
+	}
+}
+
+func TestMarshalEventDataDiffOfAddedEvent(t *testing.T) {
+	// A new event has no previous version to diff against
+	setPayloadOptions(t, PayloadOptions{Include: []string{"verb", "old_event_diff"}, OldEvent: OldEventDiff})
+	eData := NewEventData(newTestUpdate().Event, nil)
+	got, err := marshalEventData(&eData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"verb":"ADDED"}`; string(got) != want {
+		t.Errorf("Got payload %s, want %s", got, want)
+	}
+}
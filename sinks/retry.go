@@ -0,0 +1,140 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"k8s.io/apimachinery/pkg/util/wait"
+	log "k8s.io/klog/v2"
+)
+
+// retryableAWSErrorCodes are the AWS error codes of failures that are worth
+// retrying, mostly throttling and service unavailability
+var retryableAWSErrorCodes = map[string]bool{
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"ThrottledException":   true,
+	"RequestLimitExceeded": true,
+	"InternalFailure":      true,
+	"ServiceUnavailable":   true,
+	"RequestError":         true,
+
+	cloudwatchlogs.ErrCodeServiceUnavailableException: true,
+	request.ErrCodeResponseTimeout:                    true,
+}
+
+// RetryPolicy decides how often and how fast a sink retries a failed upload.
+// A nil RetryPolicy makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It doubles with
+	// every retry up to MaxBackoff, and every delay is jittered by up to 20%.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NewRetryPolicy is the factory method constructing a new RetryPolicy
+func NewRetryPolicy(maxAttempts int, initialBackoff time.Duration, maxBackoff time.Duration) (*RetryPolicy, error) {
+	if maxAttempts <= 0 {
+		return nil, fmt.Errorf("retry attempts must be positive, got %d", maxAttempts)
+	}
+	if initialBackoff <= 0 || maxBackoff < initialBackoff {
+		return nil, fmt.Errorf("invalid retry backoff %v up to %v", initialBackoff, maxBackoff)
+	}
+	return &RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+	}, nil
+}
+
+// Do calls upload until it succeeds, fails with an error that is not
+// retryable or MaxAttempts is reached, and returns the last error. Once ctx
+// is done no more attempts are made.
+func (p *RetryPolicy) Do(ctx context.Context, sink string, upload func() error) error {
+	if p == nil {
+		return upload()
+	}
+
+	backoff := wait.Backoff{
+		Duration: p.InitialBackoff,
+		Factor:   2,
+		Jitter:   0.2,
+		Steps:    math.MaxInt32,
+		Cap:      p.MaxBackoff,
+	}
+	for attempt := 1; ; attempt++ {
+		err := upload()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoff.Step()
+		log.Warningf("Attempt %d of %d of sink %s failed, retrying in %v: %v", attempt, p.MaxAttempts, sink, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryableError marks an error as retryable
+type retryableError struct {
+	error
+}
+
+// markRetryable marks err as retryable, keeping nil as is
+func markRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+// formatError is returned for an event that cannot be serialized, it is
+// never retryable
+type formatError struct {
+	error
+}
+
+// httpStatusError is returned for an unexpected HTTP response status
+type httpStatusError struct {
+	status     string
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %s", e.status)
+}
+
+// isRetryable returns true if the upload failed for a reason that may go
+// away by itself, like throttling, unavailability or a network error
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case retryableError:
+		return true
+	case formatError:
+		return false
+	case *httpStatusError:
+		return e.statusCode == http.StatusTooManyRequests || e.statusCode >= 500
+	case awserr.RequestFailure:
+		if e.StatusCode() == http.StatusTooManyRequests || e.StatusCode() >= 500 {
+			return true
+		}
+		return retryableAWSErrorCodes[e.Code()]
+	case awserr.Error:
+		return retryableAWSErrorCodes[e.Code()]
+	case net.Error:
+		return true
+	}
+	return false
+}
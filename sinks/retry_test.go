@@ -0,0 +1,122 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"plain error", errors.New("failed"), false},
+		{"marked retryable", markRetryable(errors.New("failed")), true},
+		{"format error", formatError{errors.New("failed")}, false},
+		{"HTTP 500", &httpStatusError{status: "500", statusCode: http.StatusInternalServerError}, true},
+		{"HTTP 503", &httpStatusError{status: "503", statusCode: http.StatusServiceUnavailable}, true},
+		{"HTTP 429", &httpStatusError{status: "429", statusCode: http.StatusTooManyRequests}, true},
+		{"HTTP 400", &httpStatusError{status: "400", statusCode: http.StatusBadRequest}, false},
+		{"HTTP 404", &httpStatusError{status: "404", statusCode: http.StatusNotFound}, false},
+		{"AWS throttling", awserr.New("ThrottlingException", "Rate exceeded", nil), true},
+		{"AWS service unavailable", awserr.New(cloudwatchlogs.ErrCodeServiceUnavailableException, "", nil), true},
+		{"AWS invalid parameter", awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "", nil), false},
+		{"AWS resource not found", awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "", nil), false},
+		{"AWS request failure 500", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, ""), true},
+		{"AWS request failure 429", awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), http.StatusTooManyRequests, ""), true},
+		{"AWS request failure 400 throttled", awserr.NewRequestFailure(awserr.New("ThrottlingException", "", nil), http.StatusBadRequest, ""), true},
+		{"AWS request failure 400", awserr.NewRequestFailure(awserr.New("AccessDeniedException", "", nil), http.StatusBadRequest, ""), false},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxAttempts    int
+		initialBackoff time.Duration
+		maxBackoff     time.Duration
+		wantErr        bool
+	}{
+		{"valid", 5, time.Second, 30 * time.Second, false},
+		{"single attempt", 1, time.Second, time.Second, false},
+		{"no attempts", 0, time.Second, 30 * time.Second, true},
+		{"no backoff", 5, 0, 30 * time.Second, true},
+		{"max below initial backoff", 5, time.Minute, time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRetryPolicy(tt.maxAttempts, tt.initialBackoff, tt.maxBackoff)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	retryable := markRetryable(errors.New("unavailable"))
+	permanent := errors.New("invalid")
+
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		// errs are returned by the attempts in turn, nil afterwards
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", &RetryPolicy{3, time.Millisecond, time.Millisecond}, nil, 1, nil},
+		{"retries until success", &RetryPolicy{3, time.Millisecond, time.Millisecond}, []error{retryable, retryable}, 3, nil},
+		{"stops after max attempts", &RetryPolicy{3, time.Millisecond, time.Millisecond}, []error{retryable, retryable, retryable, retryable}, 3, retryable},
+		{"does not retry permanent errors", &RetryPolicy{3, time.Millisecond, time.Millisecond}, []error{retryable, permanent}, 2, permanent},
+		{"nil policy makes a single attempt", nil, []error{retryable}, 1, retryable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := tt.policy.Do(context.Background(), "test", func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("Got error %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoStopsWhenDone(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := policy.Do(ctx, "test", func() error {
+		attempts++
+		cancel()
+		return markRetryable(errors.New("unavailable"))
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Got error %v after %d attempts, want an error after 1", err, attempts)
+	}
+}
@@ -0,0 +1,189 @@
+package sinks
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "k8s.io/klog/v2"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is an io.Writer appending to a file which is rotated once it
+// grows beyond maxSize bytes or has been open for longer than maxAge. Rotated
+// files are renamed to <path>.<timestamp>, optionally gzipped, and only the
+// newest maxBackups of them are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file path must not be empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write implements io.Writer. A single write is never split across files.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Sync commits the current file to stable storage
+func (r *rotatingFile) Sync() error {
+	return r.file.Sync()
+}
+
+// rotateIfExpired rotates the current file if it is older than maxAge and
+// not empty
+func (r *rotatingFile) rotateIfExpired() error {
+	if r.maxAge <= 0 || r.size == 0 || time.Since(r.openedAt) < r.maxAge {
+		return nil
+	}
+	return r.rotate()
+}
+
+// Close closes the current file
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the current file and opens a new one in its place. The
+// current file is only closed once the new one is open, so that writes keep
+// going to it if the rotation fails.
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	current := r.file
+	if err := r.open(); err != nil {
+		if renameErr := os.Rename(backup, r.path); renameErr != nil {
+			log.Warningf("Failed to move %s back to %s: %v", backup, r.path, renameErr)
+		}
+		return err
+	}
+	if err := current.Close(); err != nil {
+		log.Warningf("Failed to close %s: %v", backup, err)
+	}
+
+	if r.compress {
+		if err := compressFile(backup); err != nil {
+			log.Warningf("Failed to compress %s: %v", backup, err)
+		}
+	}
+	r.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups deletes all but the newest maxBackups rotated files. The
+// files being compressed are not backups yet and are left alone.
+func (r *rotatingFile) removeOldBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		log.Warningf("Failed to list backups of %s: %v", r.path, err)
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			backups = append(backups, match)
+		}
+	}
+	// The timestamp suffix sorts lexically in chronological order
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Warningf("Failed to remove old backup %s: %v", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// compressFile gzips path into path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, strings.TrimSuffix(tmp, ".tmp")); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,186 @@
+package sinks
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRecords writes the records to the file, waiting between them so that
+// each rotation gets a backup of its own
+func writeRecords(t *testing.T, r *rotatingFile, records ...string) {
+	t.Helper()
+	for _, record := range records {
+		if _, err := r.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+// readBackups returns the content of the rotated files of path, oldest first
+func readBackups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, match := range matches {
+		f, err := os.Open(match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(match, ".gz") {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	r, err := newRotatingFile(path, 10, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// A write is not split, and a write larger than the limit to an empty
+	// file does not rotate it
+	writeRecords(t, r, "aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n", "e\n")
+	if got, want := readBackups(t, path), []string{"aaaa\nbbbb\n", "cccc\n", "dddddddddddd\n"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Got backups %q, want %q", got, want)
+	}
+	if got := readFile(t, path); got != "e\n" {
+		t.Errorf("Got file %q, want %q", got, "e\n")
+	}
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	r, err := newRotatingFile(path, 0, time.Hour, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// An empty file is not rotated however old it is
+	r.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := r.rotateIfExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if backups := readBackups(t, path); len(backups) != 0 {
+		t.Fatalf("Got backups %q of an empty file", backups)
+	}
+
+	r.openedAt = time.Now()
+	writeRecords(t, r, "a\n")
+	if err := r.rotateIfExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if backups := readBackups(t, path); len(backups) != 0 {
+		t.Fatalf("Got backups %q before the file expired", backups)
+	}
+	r.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := r.rotateIfExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBackups(t, path); len(got) != 1 || got[0] != "a\n" {
+		t.Errorf("Got backups %q once the file expired, want [\"a\\n\"]", got)
+	}
+	if time.Since(r.openedAt) > time.Minute {
+		t.Errorf("Got the new file opened at %v", r.openedAt)
+	}
+}
+
+func TestRotatingFilePrunesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	// A backup being compressed is not counted nor removed
+	tmp := path + ".20200101T000000.000.gz.tmp"
+	if err := os.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRotatingFile(path, 2, 0, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	writeRecords(t, r, "1\n", "2\n", "3\n", "4\n", "5\n")
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("Got the file being compressed removed: %v", err)
+	}
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readBackups(t, path), []string{"3\n", "4\n"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Got backups %q, want %q", got, want)
+	}
+}
+
+func TestRotatingFileCompresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	r, err := newRotatingFile(path, 2, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	writeRecords(t, r, "1\n", "2\n", "3\n")
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".gz") {
+			t.Errorf("Got uncompressed backup %s", match)
+		}
+	}
+	if got, want := readBackups(t, path), []string{"1\n", "2\n"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Got backups %q, want %q", got, want)
+	}
+}
+
+func TestRotatingFileKeepsWritingAfterFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	r, err := newRotatingFile(path, 2, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	writeRecords(t, r, "1\n")
+
+	// The rename fails once the file is gone
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("2\n")); err == nil {
+		t.Fatal("Got no error rotating a removed file")
+	}
+	if err := r.Sync(); err != nil {
+		t.Errorf("Got the current file unusable after a failed rotation: %v", err)
+	}
+}
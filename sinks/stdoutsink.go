@@ -3,75 +3,66 @@ package sinks
 import (
 	"context"
 	"fmt"
-	"sync"
+	"strings"
 
-	jsoniter "github.com/json-iterator/go"
+	log "k8s.io/klog/v2"
 
-	v1 "k8s.io/api/core/v1"
-	log "k8s.io/klog"
+	"github.com/event-exporter/metrics"
 )
 
-// let's have few go routines to emit out glog.
-const concurrency = 5
-
-// UpdateEvent could be send via channels too
-type UpdateEvent struct {
-	eNew *v1.Event
-	eOld *v1.Event
-}
-
 // StdOutSink is the most basic sink
 type StdOutSink struct {
-	updateChan chan UpdateEvent
-}
-
-// NewStdoutSink will create a new
-func NewStdoutSink(ctx context.Context) EventSinkInterface {
-	ss := &StdOutSink{
-		updateChan: make(chan UpdateEvent),
-	}
+	updateChan chan EventData
 
-	var wg sync.WaitGroup
-	wg.Add(concurrency)
-	log.V(3).Infof("Starting glog sink with concurrency=%d", concurrency)
-	// let's have couple of parallel routines
-	go func() {
-		defer wg.Done()
-		ss.updateEvents(ctx)
-	}()
+	// done is closed once the sink is stopped
+	done chan struct{}
 
-	// wait
-	go func() {
-		wg.Wait()
-		log.V(3).Info("Stopping glog sink WaitGroup")
-		close(ss.updateChan)
-	}()
+	// template renders the printed lines, nil for JSON
+	template *messageTemplate
+}
 
-	return ss
+// NewStdoutSink will create a new StdOutSink, which prints the events once
+// its Run loop is started
+func NewStdoutSink() *StdOutSink {
+	return &StdOutSink{
+		updateChan: make(chan EventData),
+		done:       make(chan struct{}),
+	}
 }
 
 // UpdateEvents implements the EventSinkInterface.
 // This is not a non-blocking call because the channel could get full. But ATM I do not care because
 // glog just logs the message. It is CPU heavy (JSON Marshalling) and has no I/O. So the time complexity of the
-// blocking call is very minimal. Also we could spawn more routines of updateEvents to make it concurrent.
-func (ss *StdOutSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
-	ss.updateChan <- UpdateEvent{
-		eNew: eNew,
-		eOld: eOld,
+// blocking call is very minimal. Once the sink is stopped events are dropped instead.
+func (ss *StdOutSink) UpdateEvents(eData EventData) {
+	select {
+	case ss.updateChan <- eData:
+	case <-ss.done:
+		metrics.EventsDropped.WithLabelValues(stdoutSinkName).Inc()
+		log.V(2).Infof("Sink %s is stopped, dropping event %s/%s", stdoutSinkName, eData.Event.Namespace, eData.Event.Name)
 	}
 }
 
+// Run prints the events until ctx is done
+func (ss *StdOutSink) Run(ctx context.Context) {
+	log.V(3).Infof("Starting glog sink")
+	defer close(ss.done)
+	ss.updateEvents(ctx)
+}
+
 func (ss *StdOutSink) updateEvents(ctx context.Context) {
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	for {
 		select {
-		case event := <-ss.updateChan:
-			eData := NewEventData(event.eNew, event.eOld)
-			if eJSONBytes, err := json.Marshal(eData); err == nil {
-				fmt.Println(string(eJSONBytes))
+		case eData := <-ss.updateChan:
+			if line, err := ss.template.format(&eData); err == nil {
+				fmt.Println(strings.TrimSuffix(string(line), "\n"))
+				metrics.EventsExported.WithLabelValues(stdoutSinkName).Inc()
 			} else {
-				log.Warningf("Failed to json serialize event: %v", err)
+				metrics.ExportFailures.WithLabelValues(stdoutSinkName, "format").Inc()
+				log.Warningf("Failed to format event, skipping it: %v", err)
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,31 @@
+package sinks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStdOutSinkDropsEventsOnceStopped(t *testing.T) {
+	ss := NewStdoutSink()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ss.Run(ctx)
+		close(done)
+	}()
+	ss.UpdateEvents(newTestEventData("before"))
+
+	cancel()
+	<-done
+	sent := make(chan struct{})
+	go func() {
+		ss.UpdateEvents(newTestEventData("after"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateEvents blocked after the sink was stopped")
+	}
+}
@@ -0,0 +1,282 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/event-exporter/health"
+	"github.com/event-exporter/metrics"
+)
+
+const (
+	syslogDialTimeout  = 10 * time.Second
+	syslogWriteTimeout = 10 * time.Second
+)
+
+/*
+SyslogSink is the sink that writes the kubernetes events as RFC5424 syslog
+messages over a persistent connection. TCP and TLS connections use
+octet-counting framing, UDP sends a single message per datagram.
+If the connection fails the sink reconnects and retries the event that was
+being written according to the retry policy, after which the event is written
+to the dead letter file if there is one.
+*/
+type SyslogSink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+
+	// conn is the current connection to the syslog server, nil if disconnected
+	conn net.Conn
+
+	// buf holds the serialized message so it is written in a single call
+	buf bytes.Buffer
+
+	// retry decides how failed writes are retried, deadLetter keeps the
+	// events that failed for good
+	retry      *RetryPolicy
+	deadLetter *deadLetter
+
+	// template renders the message of each event, nil for JSON
+	template *messageTemplate
+
+	// eventCh is used to interact eventRouter and the sharedInformer
+	eventCh *eventChannel
+
+	heartbeat *health.Heartbeat
+}
+
+// NewSyslogSink is the factory method constructing a new SyslogSink. network
+// is one of tcp, udp or tls.
+func NewSyslogSink(network string, address string, tlsConfig *tls.Config, retry *RetryPolicy, overflow bool, bufferSize int) (*SyslogSink, error) {
+	switch network {
+	case "tcp", "udp":
+	case "tls":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q, must be one of tcp, udp or tls", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("syslog address must not be empty")
+	}
+
+	s := &SyslogSink{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		retry:     retry,
+		eventCh:   newEventChannel(syslogSinkName, "sink", overflow, bufferSize),
+		heartbeat: newSinkHeartbeat(syslogSinkName),
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event OverflowingChannel, which should never block.
+// Messages that are buffered beyond the bufferSize specified for this SyslogSink
+// are discarded.
+func (s *SyslogSink) UpdateEvents(eData EventData) {
+	s.eventCh.send(eData)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh,
+// and writing them to the syslog server one message at a time. Events that
+// cannot be written are dead lettered. When ctx is done the remaining events
+// are written, until the first connection failure, before Run returns.
+//
+// If a disk backed eventCh is used, events that could not be dead lettered
+// are written again after a backoff, unless they cannot be serialized.
+func (s *SyslogSink) Run(ctx context.Context) {
+	defer s.eventCh.close()
+	defer s.deadLetter.close()
+	defer s.disconnect()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	backoff := newSinkBackoff()
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			evt, ok := s.eventCh.event(e)
+			if !ok {
+				continue
+			}
+			err := s.send(ctx, evt)
+			if err == nil || s.deadLetter.writeEvents([]EventData{evt}) {
+				s.eventCh.ack()
+				backoff = newSinkBackoff()
+				continue
+			}
+			if !s.eventCh.redeliver(err, 1) {
+				log.Warningf("Dropping event %s/%s: %v", evt.Event.Namespace, evt.Event.Name, err)
+				continue
+			}
+			if ctx.Err() == nil {
+				select {
+				case <-time.After(backoff.Step()):
+				case <-ctx.Done():
+				}
+			}
+		case <-heartbeatTicker.C:
+			s.heartbeat.Beat()
+		case <-ctx.Done():
+			events := s.eventCh.drain()
+			for i, evt := range events {
+				err := s.send(ctx, evt)
+				if err != nil && !isRetryable(err) {
+					s.deadLetter.writeEvents([]EventData{evt})
+					continue
+				}
+				if err != nil {
+					// There is no time left for retries, dead letter the rest
+					s.deadLetter.writeEvents(events[i:])
+					return
+				}
+			}
+			s.eventCh.ack()
+			return
+		}
+	}
+}
+
+// send writes the event to the syslog server, reconnecting and retrying
+// according to the retry policy
+func (s *SyslogSink) send(ctx context.Context, evt EventData) error {
+	err := s.retry.Do(ctx, syslogSinkName, func() error {
+		// Reconnecting is progress, the server being down is no reason to restart
+		s.heartbeat.Beat()
+		err := s.connect()
+		if err == nil {
+			if err = s.write(&evt); err == nil {
+				return nil
+			}
+			if _, ok := err.(formatError); ok {
+				metrics.ExportFailures.WithLabelValues(syslogSinkName, "format").Inc()
+				return err
+			}
+			s.disconnect()
+		}
+		metrics.ExportFailures.WithLabelValues(syslogSinkName, "connection").Inc()
+		// Every connection failure is worth retrying, including TLS errors
+		return markRetryable(err)
+	})
+	if err != nil {
+		log.Warningf("Failed to write event to syslog %s://%s: %v", s.network, s.address, err)
+		return err
+	}
+	metrics.EventsExported.WithLabelValues(syslogSinkName).Inc()
+	return nil
+}
+
+// connect dials the syslog server if there is no open connection
+func (s *SyslogSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Connected to syslog %s://%s", s.network, s.address)
+	s.conn = conn
+	return nil
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if s.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.address)
+}
+
+// Check implements the Checker interface. It opens and closes a separate
+// connection to the syslog server, for UDP this only resolves the address.
+func (s *SyslogSink) Check() error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (s *SyslogSink) disconnect() {
+	if s.conn == nil {
+		return
+	}
+	s.conn.Close()
+	s.conn = nil
+}
+
+// write sends a single event over the current connection
+func (s *SyslogSink) write(evt *EventData) error {
+	s.buf.Reset()
+	if err := s.serialize(evt); err != nil {
+		// The event can never be serialized, there is no point in retrying
+		return formatError{fmt.Errorf("failed to serialize event: %v", err)}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := s.conn.Write(s.buf.Bytes())
+	return err
+}
+
+// serialize writes the RFC5424 message of the event to the buffer, prefixed
+// with its length unless it is sent over UDP
+func (s *SyslogSink) serialize(evt *EventData) error {
+	if s.template == nil {
+		if s.network == "udp" {
+			b, err := evt.MarshalRFC5424()
+			s.buf.Write(b)
+			return err
+		}
+		_, err := evt.WriteRFC5424(&s.buf)
+		return err
+	}
+
+	msg, err := evt.rfc5424MessageWith(s.template)
+	if err != nil {
+		return err
+	}
+	if s.network == "udp" {
+		b, err := msg.MarshalBinary()
+		s.buf.Write(b)
+		return err
+	}
+	_, err = msg.WriteTo(&s.buf)
+	return err
+}
+
+// newSyslogTLSConfig builds the tls configuration for the syslog sink. If
+// caFile is set, the server certificate is verified against it instead of
+// the system roots.
+func newSyslogTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read syslog CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in syslog CA file %s", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
@@ -0,0 +1,245 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/rfc5424"
+	"github.com/eapache/channels"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestSyslogSink returns a SyslogSink like NewSyslogSink does, but whose
+// buffer is not registered in the metrics so tests can create several
+func newTestSyslogSink(network string, address string, tlsConfig *tls.Config) *SyslogSink {
+	return &SyslogSink{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		eventCh:   &eventChannel{sink: syslogSinkName, mem: channels.NewNativeChannel(100)},
+		heartbeat: newSinkHeartbeat(syslogSinkName),
+	}
+}
+
+// newTestSyslogEvent returns the event data of an event with the fields
+// that end up in the syslog header
+func newTestSyslogEvent(name string) EventData {
+	return EventData{
+		Verb: "ADDED",
+		Event: &v1.Event{
+			ObjectMeta:    metav1.ObjectMeta{Namespace: "default", Name: name},
+			Message:       "message of " + name,
+			Source:        v1.EventSource{Component: "kubelet", Host: "node-1"},
+			LastTimestamp: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		},
+	}
+}
+
+// syslogServer listens for syslog messages and sends each message it
+// receives, without framing, to messages
+type syslogServer struct {
+	address  string
+	messages chan []byte
+}
+
+// newSyslogServer starts a syslog server on the network, which is one of tcp,
+// udp or tls. It returns the client tls configuration trusting the server for
+// tls.
+func newSyslogServer(t *testing.T, network string) (*syslogServer, *tls.Config) {
+	s := &syslogServer{messages: make(chan []byte, 100)}
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		s.address = conn.LocalAddr().String()
+		go s.readDatagrams(conn)
+		return s, nil
+	}
+
+	var clientConfig *tls.Config
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network == "tls" {
+		// Borrow the certificate of an httptest server, which is valid for
+		// 127.0.0.1
+		ts := httptest.NewUnstartedServer(nil)
+		ts.StartTLS()
+		ts.Close()
+		l = tls.NewListener(l, &tls.Config{Certificates: ts.TLS.Certificates})
+		roots := x509.NewCertPool()
+		roots.AddCert(ts.Certificate())
+		clientConfig = &tls.Config{RootCAs: roots}
+	}
+	t.Cleanup(func() { l.Close() })
+	s.address = l.Addr().String()
+	go s.acceptStreams(t, l)
+	return s, clientConfig
+}
+
+func (s *syslogServer) readDatagrams(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.messages <- append([]byte(nil), buf[:n]...)
+	}
+}
+
+func (s *syslogServer) acceptStreams(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.readFrames(t, conn)
+	}
+}
+
+// readFrames reads the octet counted messages of a connection
+func (s *syslogServer) readFrames(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		prefix, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if err != nil {
+			t.Errorf("Invalid octet count %q: %v", prefix, err)
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Errorf("Failed to read message of %d bytes: %v", n, err)
+			return
+		}
+		s.messages <- msg
+	}
+}
+
+// receive returns the next message received by the server
+func (s *syslogServer) receive(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a syslog message")
+		return nil
+	}
+}
+
+// runSyslogSink runs the sink until the test is done
+func runSyslogSink(t *testing.T, s *SyslogSink) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestSyslogSinkFraming(t *testing.T) {
+	for _, network := range []string{"tcp", "udp", "tls"} {
+		t.Run(network, func(t *testing.T) {
+			server, tlsConfig := newSyslogServer(t, network)
+			s := newTestSyslogSink(network, server.address, tlsConfig)
+			runSyslogSink(t, s)
+
+			// Several messages share a stream, the framing must keep them apart
+			for _, name := range []string{"a", "b"} {
+				evt := newTestSyslogEvent(name)
+				s.UpdateEvents(evt)
+				want, err := evt.MarshalRFC5424()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := server.receive(t); string(got) != string(want) {
+					t.Errorf("Got message %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogSinkWriteRFC5424(t *testing.T) {
+	// WriteRFC5424 is the octet counted form of MarshalRFC5424
+	evt := newTestSyslogEvent("a")
+	msg, err := evt.MarshalRFC5424()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var framed strings.Builder
+	if _, err := evt.WriteRFC5424(&framed); err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(len(msg)) + " " + string(msg); framed.String() != want {
+		t.Errorf("Got framed message %q, want %q", framed.String(), want)
+	}
+}
+
+func TestSyslogSinkTemplate(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			server, _ := newSyslogServer(t, network)
+			s := newTestSyslogSink(network, server.address, nil)
+			template, err := newMessageTemplate(syslogSinkName, "{{.Event.Namespace}}/{{.Event.Message}}")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.template = template
+			runSyslogSink(t, s)
+
+			s.UpdateEvents(newTestSyslogEvent("a"))
+			var msg rfc5424.Message
+			if err := msg.UnmarshalBinary(server.receive(t)); err != nil {
+				t.Fatal(err)
+			}
+			if want := "default/message of a"; string(msg.Message) != want {
+				t.Errorf("Got message %q, want %q", msg.Message, want)
+			}
+			if msg.Hostname != "node-1" || msg.AppName != "kubelet" {
+				t.Errorf("Got hostname %q and app name %q, want node-1 and kubelet", msg.Hostname, msg.AppName)
+			}
+		})
+	}
+}
+
+func TestNewSyslogSinkInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+	}{
+		{"unsupported network", "unix", "/dev/log"},
+		{"empty address", "tcp", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSyslogSink(tt.network, tt.address, nil, nil, false, 10); err == nil {
+				t.Error("Got no error, want one")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// messageTemplateFuncs are the functions available to message templates
+var messageTemplateFuncs = template.FuncMap{
+	// toJson returns the JSON serialization of a value
+	"toJson": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// ago returns how long ago a timestamp was, e.g. 3m20s
+	"ago": func(t interface{}) (string, error) {
+		var since time.Time
+		switch t := t.(type) {
+		case time.Time:
+			since = t
+		case metav1.Time:
+			since = t.Time
+		case *metav1.Time:
+			if t != nil {
+				since = t.Time
+			}
+		case metav1.MicroTime:
+			since = t.Time
+		case *metav1.MicroTime:
+			if t != nil {
+				since = t.Time
+			}
+		default:
+			return "", fmt.Errorf("ago expects a timestamp, got %T", t)
+		}
+		if since.IsZero() {
+			return "", nil
+		}
+		return time.Since(since).Round(time.Second).String(), nil
+	},
+	// label returns the value of a label of a kubernetes object or of the
+	// involved object metadata, e.g. {{ .InvolvedObject | label "app" }}
+	"label": func(key string, obj interface{}) string {
+		if m, ok := obj.(*ObjectMetadata); ok {
+			if m == nil {
+				return ""
+			}
+			return m.Labels[key]
+		}
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return ""
+		}
+		return accessor.GetLabels()[key]
+	},
+}
+
+// messageTemplate renders the message a sink exports for an event through a
+// user supplied text/template, with the EventData as root. A nil
+// messageTemplate formats the payload as JSON instead, see marshalEventData.
+type messageTemplate struct {
+	t   *template.Template
+	buf bytes.Buffer
+}
+
+// newMessageTemplate parses the template text, it returns nil if text is
+// empty
+func newMessageTemplate(name string, text string) (*messageTemplate, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(messageTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return &messageTemplate{t: t}, nil
+}
+
+// format returns the message for the event data. The returned slice is only
+// valid until the next call.
+func (m *messageTemplate) format(e *EventData) ([]byte, error) {
+	if m == nil {
+		return marshalEventData(e)
+	}
+	m.buf.Reset()
+	if err := m.t.Execute(&m.buf, e); err != nil {
+		return nil, err
+	}
+	return m.buf.Bytes(), nil
+}